@@ -5,82 +5,429 @@ import (
 	"debug/elf"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
+	"os"
 )
 
 const textSection = ".text"
-const relocationSection = ".rela.text"
 
-// LoadFakeImageFromEmbedFs builds FakeImage from the embed filesystem. It parses the ELF file and extract the variables from the relocation section, reserves the space for them at the end of content, then calculates and saves offsets as "manually relocation"
+// unwindSection is generated by compilers unless -fno-asynchronous-unwind-tables,
+// it is not needed by the fake image and ignored with its relocations
+const unwindSection = ".eh_frame"
+
+// externVarLength is the space reserved for an extern variable, every variable
+// set by Skew is 64 bits. A variable declared shorter reads the low bytes.
+const externVarLength = 8
+
+// maxVarLength is the max length of a variable defined in the object
+const maxVarLength = 8
+
+// pointerLength is the length of a GOT slot
+const pointerLength = 8
+
+// relocationClass is how the symbol of a relocation is resolved
+type relocationClass int
+
+const (
+	// relocDirect refers to the symbol itself
+	relocDirect relocationClass = iota
+	// relocGOT refers to a GOT slot holding the address of the symbol
+	relocGOT
+	// relocCall calls or jumps to a function, which must be in the image
+	relocCall
+)
+
+// imageRelocation is a relocation of the fake image resolved to offsets within
+// the content. It is applied by applyRelocation when the image is mapped, as
+// most relocations depend on the address of the image.
+type imageRelocation struct {
+	relaType uint32
+	// offset is where the relocation is applied
+	offset uint64
+	// target is the offset of the symbol or its GOT slot, plus addend
+	target int64
+	// symbol is the name of the symbol, only for errors
+	symbol string
+}
+
+// linkTestBase is the address used to link the image when it is loaded, so the
+// errors of relocations are found before injecting
+const linkTestBase = 0x7f0000000000
+
+// LoadFakeImageFromEmbedFs builds FakeImage from the embed filesystem. It parses
+// the ELF file, lays out the loaded sections and the variables, then resolves
+// the relocations to offsets within the image, see loadFakeImage
 func LoadFakeImageFromEmbedFs(filename string, symbolName string) (*FakeImage, error) {
 	path := "fakeclock/" + filename
-	log.Printf("[LOAD DEBUG] %s: reading %s", symbolName, path)
+	logger().Debug("reading fake image", "symbol", symbolName, "path", path)
 	object, err := fakeclock.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("%T read file from embedded fs %s", err, path)
+		return nil, fmt.Errorf("%w read file from embedded fs %s", err, path)
 	}
+	return loadFakeImage(object, path, symbolName)
+}
 
+// LoadFakeImageFromFile builds FakeImage from a relocatable object compiled like
+// the ones in fakeclock, which replaces symbolName in vDSO. The hook function must
+// be at the beginning of .text, and may only use the extern variables of the
+// built-in images, see Skew.SetImage.
+func LoadFakeImageFromFile(path string, symbolName string) (*FakeImage, error) {
+	object, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w read fake image %s", err, path)
+	}
+	return loadFakeImage(object, path, symbolName)
+}
+
+// LoadFakeImageFromReader is the same as LoadFakeImageFromFile, but reads the
+// object from r
+func LoadFakeImageFromReader(r io.Reader, symbolName string) (*FakeImage, error) {
+	object, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w read fake image of %s", err, symbolName)
+	}
+	return loadFakeImage(object, "fake image of "+symbolName, symbolName)
+}
+
+// imageLoader lays out the fake image of an object, path is only used in the
+// errors and logs
+type imageLoader struct {
+	elfFile *elf.File
+	path    string
+	syms    []elf.Symbol
+
+	content []byte
+	// dataOffset is the beginning of the writable part of content
+	dataOffset uint64
+	// sectionOffset is the offset of every loaded section within content
+	sectionOffset map[elf.SectionIndex]uint64
+	offset        map[string]int
+	lengths       map[string]int
+	// got is the offset of the GOT slot of every symbol
+	got         map[int64]uint64
+	relocations []imageRelocation
+}
+
+// loadFakeImage validates the object and lays out the image like:
+//
+//	| entry stub | .text | .rodata | padding | .data and .bss | extern variables | GOT slots |
+//
+// The beginning of the image is jumped to from vDSO, so the entry stub jumps to
+// the hook function if it is not at the beginning of .text, see entryFunction.
+// The part from .data is on its own pages, which are kept writable when the code
+// is made executable, see InjectFakeImage.
+// The variables are the extern symbols and the global objects defined in
+// writable sections, the other globals must be static.
+func loadFakeImage(object []byte, path string, symbolName string) (*FakeImage, error) {
 	elfFile, err := elf.NewFile(bytes.NewReader(object))
 	if err != nil {
-		return nil, fmt.Errorf("%T parse elf file %s", err, path)
+		return nil, fmt.Errorf("%w parse elf file %s", err, path)
+	}
+	if elfFile.Class != elf.ELFCLASS64 || elfFile.Type != elf.ET_REL {
+		return nil, fmt.Errorf("%s is %s %s, expected a 64-bit relocatable object", path, elfFile.Class, elfFile.Type)
+	}
+	if elfFile.Machine != elfMachine {
+		return nil, fmt.Errorf("unsupported architecture in %s: '%s', expected '%s'", path, elfFile.Machine, elfMachine)
 	}
 
 	syms, err := elfFile.Symbols()
 	if err != nil {
-		return nil, fmt.Errorf("%T get symbols %s", err, path)
+		return nil, fmt.Errorf("%w get symbols %s", err, path)
 	}
 
-	var imageContent []byte
-	imageOffset := make(map[string]int)
+	l := &imageLoader{
+		elfFile:       elfFile,
+		path:          path,
+		syms:          syms,
+		sectionOffset: make(map[elf.SectionIndex]uint64),
+		offset:        make(map[string]int),
+		lengths:       make(map[string]int),
+		got:           make(map[int64]uint64),
+	}
+	err = l.loadSections()
+	if err != nil {
+		return nil, err
+	}
+	err = l.loadVariables()
+	if err != nil {
+		return nil, err
+	}
 
-	for _, r := range elfFile.Sections {
-		if r.Type == elf.SHT_PROGBITS && r.Name == textSection {
-			log.Printf("[LOAD DEBUG] %s: importing textSection", symbolName)
-			imageContent, err = r.Data()
-			if err != nil {
-				return nil, fmt.Errorf("%T read text section data %s", err, path)
-			}
-			break
+	for i, section := range elfFile.Sections {
+		if section.Type != elf.SHT_RELA {
+			continue
+		}
+		// the relocations of .eh_frame and debug sections are ignored with them
+		target := elf.SectionIndex(section.Info)
+		if _, ok := l.sectionOffset[target]; !ok {
+			continue
 		}
+		logger().Debug("importing relocations", "symbol", symbolName, "section", section.Name)
+		err = l.loadRelocations(elf.SectionIndex(i), target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	image := NewFakeImage(symbolName, l.content, l.offset)
+	image.lengths = l.lengths
+	image.relocations = l.relocations
+	image.dataOffset = l.dataOffset
+	_, err = image.link(linkTestBase)
+	if err != nil {
+		return nil, fmt.Errorf("%w in %s", err, path)
+	}
+	return image, nil
+}
+
+// loadSections appends .text and the other allocated sections to content
+func (l *imageLoader) loadSections() error {
+	text := l.elfFile.Section(textSection)
+	if text == nil || text.Type != elf.SHT_PROGBITS || text.Flags&elf.SHF_EXECINSTR == 0 || text.Size == 0 {
+		return fmt.Errorf("%s has no %s section, the hook must not be compiled with -ffunction-sections", l.path, textSection)
+	}
+	entry, err := l.entryFunction(text)
+	if err != nil {
+		return err
+	}
+	if entry.Value != 0 {
+		// e.g. gcc places the clones of static functions like add.constprop.0
+		// before the hook
+		logger().Debug("jumping to hook", "path", l.path, "hook", entry.Name, "offset", entry.Value)
+		l.content = append(l.content, entryStub...)
 	}
 
-	for _, r := range elfFile.Sections {
-		if r.Type == elf.SHT_RELA && r.Name == relocationSection {
-			log.Printf("[LOAD DEBUG] %s: importing relocationSection", symbolName)
-			relaSection, err := r.Data()
-			if err != nil {
-				return nil, fmt.Errorf("%T read rela section data %s", err, path)
+	// .text is loaded first, so the hook function is at the beginning of the image,
+	// and the writable sections are loaded after the read only ones
+	indexes := []int{}
+	var writable []int
+	for i, section := range l.elfFile.Sections {
+		if section == text {
+			indexes = append([]int{i}, indexes...)
+			continue
+		}
+		switch section.Type {
+		case elf.SHT_PROGBITS, elf.SHT_NOBITS:
+			if section.Name == unwindSection || section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 {
+				continue
+			}
+			if section.Flags&elf.SHF_EXECINSTR != 0 {
+				return fmt.Errorf("section %s in %s is not supported, the code must be in %s", section.Name, l.path, textSection)
 			}
-			relaSectionReader := bytes.NewReader(relaSection)
-
-			var rela elf.Rela64
-			for relaSectionReader.Len() > 0 {
-				err := binary.Read(relaSectionReader, elfFile.ByteOrder, &rela)
-				if err != nil {
-					return nil, fmt.Errorf("%T read rela section rela64 entry %s", err, path)
-				}
-
-				symNo := rela.Info >> 32
-				if symNo == 0 || symNo > uint64(len(syms)) {
-					continue
-				}
-
-				sym := syms[symNo-1]
-				byteorder := elfFile.ByteOrder
-				if elfFile.Machine == elf.EM_X86_64 || elfFile.Machine == elf.EM_AARCH64 {
-					log.Printf("[LOAD DEBUG] %s: loading %s from %#x with %s", symbolName, sym.Name, rela.Off, byteorder)
-					AssetLD(rela, imageOffset, &imageContent, sym, byteorder)
-				} else {
-					return nil, fmt.Errorf("unsupported architecture in %s: '%s'", path, elfFile.Machine)
-				}
+			if section.Flags&elf.SHF_WRITE != 0 {
+				writable = append(writable, i)
+				continue
 			}
+			indexes = append(indexes, i)
+		case elf.SHT_REL:
+			return fmt.Errorf("section %s in %s is not supported, only SHT_RELA is", section.Name, l.path)
+		case elf.SHT_RELA:
+			if int(section.Info) >= len(l.elfFile.Sections) {
+				return fmt.Errorf("section %s in %s relocates unknown section %d", section.Name, l.path, section.Info)
+			}
+		}
+	}
 
-			break
+	for n, i := range append(indexes, writable...) {
+		if n == len(indexes) {
+			l.alignData()
 		}
+		section := l.elfFile.Sections[i]
+		logger().Debug("loading section", "path", l.path, "section", section.Name, "size", section.Size)
+		l.align(section.Addralign)
+		l.sectionOffset[elf.SectionIndex(i)] = uint64(len(l.content))
+		if section.Type == elf.SHT_NOBITS {
+			l.content = append(l.content, make([]byte, section.Size)...)
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return fmt.Errorf("%w read section %s data %s", err, section.Name, l.path)
+		}
+		l.content = append(l.content, data...)
+	}
+	if len(writable) == 0 {
+		l.alignData()
+	}
+
+	if entry.Value != 0 {
+		l.relocations = append(l.relocations, imageRelocation{
+			relaType: entryStubRelocation,
+			offset:   entryStubOffset,
+			target:   int64(l.sectionOffset[entry.Section]+entry.Value) + entryStubAddend,
+			symbol:   entry.Name,
+		})
+	}
+	return nil
+}
+
+// align pads content to a multiple of alignment
+func (l *imageLoader) align(alignment uint64) {
+	if alignment > 1 {
+		padding := (alignment - uint64(len(l.content))%alignment) % alignment
+		l.content = append(l.content, make([]byte, padding)...)
+	}
+}
+
+// alignData pads content so the writable part begins at a page of the mapping,
+// which starts with the FakeImageHeader
+func (l *imageLoader) alignData() {
+	pageSize := uint64(os.Getpagesize())
+	padding := (pageSize - (fakeImageHeaderSize+uint64(len(l.content)))%pageSize) % pageSize
+	l.content = append(l.content, make([]byte, padding)...)
+	l.dataOffset = uint64(len(l.content))
+}
+
+// loadVariables finds the global objects defined in the writable sections
+func (l *imageLoader) loadVariables() error {
+	for _, sym := range l.syms {
+		if elf.ST_BIND(sym.Info) != elf.STB_GLOBAL || elf.ST_TYPE(sym.Info) != elf.STT_OBJECT {
+			continue
+		}
+		sectionOffset, ok := l.sectionOffset[sym.Section]
+		if !ok || l.elfFile.Sections[sym.Section].Flags&elf.SHF_WRITE == 0 {
+			continue
+		}
+		if sym.Size == 0 || sym.Size > maxVarLength {
+			return fmt.Errorf("variable %s in %s has %d bytes, expected 1 to %d", sym.Name, l.path, sym.Size, maxVarLength)
+		}
+		l.offset[sym.Name] = int(sectionOffset + sym.Value)
+		l.lengths[sym.Name] = int(sym.Size)
+	}
+	return nil
+}
+
+// variable returns the offset of an extern variable, the space is reserved at
+// the first reference and shared by all the references
+func (l *imageLoader) variable(sym elf.Symbol, length uint64, alignment uint64) (uint64, error) {
+	if offset, ok := l.offset[sym.Name]; ok {
+		return uint64(offset), nil
+	}
+	if length == 0 {
+		length = externVarLength
+	}
+	if length > maxVarLength {
+		return 0, fmt.Errorf("variable %s in %s has %d bytes, expected 1 to %d", sym.Name, l.path, length, maxVarLength)
+	}
+	if alignment < externVarLength {
+		alignment = externVarLength
+	}
+	l.align(alignment)
+	offset := uint64(len(l.content))
+	l.content = append(l.content, make([]byte, externVarLength)...)
+	l.offset[sym.Name] = int(offset)
+	l.lengths[sym.Name] = int(length)
+	return offset, nil
+}
+
+// symbolOffset returns the offset of the symbol within content
+func (l *imageLoader) symbolOffset(sym elf.Symbol, class relocationClass) (int64, error) {
+	switch sym.Section {
+	case elf.SHN_UNDEF:
+		if class == relocCall {
+			return 0, fmt.Errorf("%s calls undefined function %s, only the functions in the object could be called", l.path, sym.Name)
+		}
+		offset, err := l.variable(sym, 0, 0)
+		return int64(offset), err
+	case elf.SHN_COMMON:
+		// an uninitialized global compiled with -fcommon, the value is the alignment
+		offset, err := l.variable(sym, sym.Size, sym.Value)
+		return int64(offset), err
+	}
+	sectionOffset, ok := l.sectionOffset[sym.Section]
+	if !ok {
+		return 0, fmt.Errorf("symbol %s in %s is in a section which is not loaded", sym.Name, l.path)
+	}
+	return int64(sectionOffset + sym.Value), nil
+}
+
+// gotSlot returns the offset of the GOT slot holding the address of the symbol
+// at symOffset, the slot is filled by an absolute relocation
+func (l *imageLoader) gotSlot(symOffset int64, symbol string) uint64 {
+	if slot, ok := l.got[symOffset]; ok {
+		return slot
+	}
+	l.align(pointerLength)
+	slot := uint64(len(l.content))
+	l.content = append(l.content, make([]byte, pointerLength)...)
+	l.got[symOffset] = slot
+	l.relocations = append(l.relocations, imageRelocation{
+		relaType: absRelocation,
+		offset:   slot,
+		target:   symOffset,
+		symbol:   symbol,
+	})
+	return slot
+}
+
+// loadRelocations resolves the relocations in section which relocate target
+func (l *imageLoader) loadRelocations(section elf.SectionIndex, target elf.SectionIndex) error {
+	relaSection, err := l.elfFile.Sections[section].Data()
+	if err != nil {
+		return fmt.Errorf("%w read rela section data %s", err, l.path)
+	}
+	targetSection := l.elfFile.Sections[target]
+	relaSectionReader := bytes.NewReader(relaSection)
+
+	var rela elf.Rela64
+	for relaSectionReader.Len() > 0 {
+		err := binary.Read(relaSectionReader, l.elfFile.ByteOrder, &rela)
+		if err != nil {
+			return fmt.Errorf("%w read rela section rela64 entry %s", err, l.path)
+		}
+
+		relaType := elf.R_TYPE64(rela.Info)
+		class, ok := relocationClasses[relaType]
+		if !ok {
+			return fmt.Errorf("relocation %s at %#x of %s in %s is not supported",
+				relocationName(relaType), rela.Off, targetSection.Name, l.path)
+		}
+		symNo := elf.R_SYM64(rela.Info)
+		if symNo == 0 || symNo > uint32(len(l.syms)) {
+			return fmt.Errorf("relocation at %#x of %s in %s has no symbol", rela.Off, targetSection.Name, l.path)
+		}
+		if rela.Off >= targetSection.Size {
+			return fmt.Errorf("relocation at %#x is out of %s in %s", rela.Off, targetSection.Name, l.path)
+		}
+
+		sym := l.syms[symNo-1]
+		symOffset, err := l.symbolOffset(sym, class)
+		if err != nil {
+			return err
+		}
+		if class == relocGOT {
+			symOffset = int64(l.gotSlot(symOffset, sym.Name))
+		}
+		logger().Debug("relocation", "path", l.path, "type", relocationName(relaType), "symbol", sym.Name, "offset", rela.Off, "section", targetSection.Name)
+		l.relocations = append(l.relocations, imageRelocation{
+			relaType: relaType,
+			offset:   l.sectionOffset[target] + rela.Off,
+			target:   symOffset + rela.Addend,
+			symbol:   sym.Name,
+		})
+	}
+	return nil
+}
+
+// entryFunction returns the hook function, which is the global function at the
+// beginning of text, or the only global function in text
+func (l *imageLoader) entryFunction(text *elf.Section) (elf.Symbol, error) {
+	var functions []elf.Symbol
+	for _, sym := range l.syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || elf.ST_BIND(sym.Info) != elf.STB_GLOBAL || int(sym.Section) >= len(l.elfFile.Sections) {
+			continue
+		}
+		if l.elfFile.Sections[sym.Section] != text {
+			continue
+		}
+		if sym.Value == 0 {
+			return sym, nil
+		}
+		functions = append(functions, sym)
+	}
+	if len(functions) != 1 {
+		return elf.Symbol{}, fmt.Errorf("%s has %d global functions in %s, expected the hook only, the others must be static",
+			l.path, len(functions), textSection)
 	}
-	return NewFakeImage(
-		symbolName,
-		imageContent,
-		imageOffset,
-	), nil
+	return functions[0], nil
 }
@@ -3,28 +3,86 @@ package watchmaker
 import (
 	"debug/elf"
 	"embed"
-	"encoding/binary"
+	"fmt"
+	"math"
 )
 
 //go:embed fakeclock/*_amd64.o
 var fakeclock embed.FS
 
-func AssetLD(rela elf.Rela64, imageOffset map[string]int, imageContent *[]byte, sym elf.Symbol, byteorder binary.ByteOrder) {
-	// The relocation of a X86 image is like:
-	// Relocation section '.rela.text' at offset 0x288 contains 3 entries:
-	// Offset          Info           Type           Sym. Value    Sym. Name + Addend
-	// 000000000016  000900000002 R_X86_64_PC32     0000000000000000 CLOCK_IDS_MASK - 4
-	// 00000000001f  000a00000002 R_X86_64_PC32     0000000000000008 TV_NSEC_DELTA - 4
-	// 00000000002a  000b00000002 R_X86_64_PC32     0000000000000010 TV_SEC_DELTA - 4
-	//
-	// For example, we need to write the offset of `CLOCK_IDS_MASK` - 4 in 0x16 of the section
-	// If we want to put the `CLOCK_IDS_MASK` at the end of the section, it will be
-	// len(imageContent) - 4 - 0x16
-
-	imageOffset[sym.Name] = len(*imageContent)
-	targetOffset := uint32(len(*imageContent)) - uint32(rela.Off) + uint32(rela.Addend)
-	byteorder.PutUint32((*imageContent)[rela.Off:rela.Off+4], targetOffset)
-
-	// TODO: support other length besides uint64 (which is 8 bytes)
-	*imageContent = append(*imageContent, make([]byte, varLength)...)
+// elfMachine is the machine of the fake images
+const elfMachine = elf.EM_X86_64
+
+// absRelocation fills a GOT slot with the address of the symbol
+const absRelocation = uint32(elf.R_X86_64_64)
+
+// relocationClasses are the supported relocations. The relocation of a X86 image
+// is like:
+//
+//	Relocation section '.rela.text' at offset 0x288 contains 3 entries:
+//	Offset          Info           Type           Sym. Value    Sym. Name + Addend
+//	000000000016  000900000002 R_X86_64_PC32     0000000000000000 CLOCK_IDS_MASK - 4
+//	00000000001f  000a00000002 R_X86_64_PC32     0000000000000008 TV_NSEC_DELTA - 4
+//	00000000002a  000b00000002 R_X86_64_PC32     0000000000000010 TV_SEC_DELTA - 4
+//
+// -fPIC accesses the extern variables through GOT with R_X86_64_REX_GOTPCRELX,
+// and calls of the functions not inlined are R_X86_64_PLT32.
+var relocationClasses = map[uint32]relocationClass{
+	uint32(elf.R_X86_64_64):            relocDirect,
+	uint32(elf.R_X86_64_PC32):          relocDirect,
+	uint32(elf.R_X86_64_PC64):          relocDirect,
+	uint32(elf.R_X86_64_PLT32):         relocCall,
+	uint32(elf.R_X86_64_GOTPCREL):      relocGOT,
+	uint32(elf.R_X86_64_GOTPCRELX):     relocGOT,
+	uint32(elf.R_X86_64_REX_GOTPCRELX): relocGOT,
+}
+
+func relocationName(relaType uint32) string {
+	return elf.R_X86_64(relaType).String()
+}
+
+// applyRelocation writes the relocation r to content mapped at base. For
+// example, for `CLOCK_IDS_MASK - 4` at 0x16 above, the offset of CLOCK_IDS_MASK
+// - 4 - 0x16 is written to 0x16. The GOT slots and the PLT are within the image,
+// so they are relocated the same as the variables.
+func applyRelocation(content []byte, r imageRelocation, base uint64) error {
+	place := base + r.offset
+	value := uint64(int64(base) + r.target)
+
+	switch elf.R_X86_64(r.relaType) {
+	case elf.R_X86_64_64:
+		if r.offset+8 > uint64(len(content)) {
+			break
+		}
+		endian.PutUint64(content[r.offset:], value)
+		return nil
+	case elf.R_X86_64_PC64:
+		if r.offset+8 > uint64(len(content)) {
+			break
+		}
+		endian.PutUint64(content[r.offset:], value-place)
+		return nil
+	case elf.R_X86_64_PC32, elf.R_X86_64_PLT32, elf.R_X86_64_GOTPCREL, elf.R_X86_64_GOTPCRELX, elf.R_X86_64_REX_GOTPCRELX:
+		if r.offset+4 > uint64(len(content)) {
+			break
+		}
+		rel := int64(value - place)
+		if rel < math.MinInt32 || rel > math.MaxInt32 {
+			return fmt.Errorf("relocation %s at %#x against %s overflows", relocationName(r.relaType), r.offset, r.symbol)
+		}
+		endian.PutUint32(content[r.offset:], uint32(int32(rel)))
+		return nil
+	default:
+		return fmt.Errorf("relocation %s at %#x against %s is not supported", relocationName(r.relaType), r.offset, r.symbol)
+	}
+	return fmt.Errorf("relocation %s at %#x against %s is out of the image", relocationName(r.relaType), r.offset, r.symbol)
 }
+
+// entryStub is `jmp rel32` to the hook function, see loadFakeImage
+var entryStub = []byte{0xe9, 0, 0, 0, 0, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc}
+
+const (
+	entryStubRelocation = uint32(elf.R_X86_64_PC32)
+	entryStubOffset     = 1
+	entryStubAddend     = -4
+)
@@ -0,0 +1,209 @@
+package watchmaker
+
+import (
+	"bytes"
+	"debug/elf"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestApplyRelocation(t *testing.T) {
+	const base = uint64(0x7f0000000000)
+	tests := []struct {
+		name     string
+		relaType elf.R_X86_64
+		offset   uint64
+		target   int64
+		// expected is the bytes written at offset, nil if err is expected
+		expected []byte
+		err      string
+	}{
+		{
+			name:     "PC32 forward",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x10,
+			target:   0x100 - 4,
+			expected: []byte{0xec, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "PC32 backward",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x10,
+			target:   -4,
+			expected: []byte{0xec, 0xff, 0xff, 0xff},
+		},
+		{
+			name:     "PC32 max",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x10,
+			target:   0x10 + math.MaxInt32,
+			expected: []byte{0xff, 0xff, 0xff, 0x7f},
+		},
+		{
+			name:     "PC32 overflow",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x10,
+			target:   0x10 + math.MaxInt32 + 1,
+			err:      "overflows",
+		},
+		{
+			name:     "PC32 underflow",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x10,
+			target:   0x10 + math.MinInt32 - 1,
+			err:      "overflows",
+		},
+		{
+			name:     "PLT32",
+			relaType: elf.R_X86_64_PLT32,
+			offset:   0x10,
+			target:   0x40 - 4,
+			expected: []byte{0x2c, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "PLT32 overflow",
+			relaType: elf.R_X86_64_PLT32,
+			offset:   0x10,
+			target:   1 << 32,
+			err:      "overflows",
+		},
+		{
+			name:     "GOTPCREL",
+			relaType: elf.R_X86_64_GOTPCREL,
+			offset:   0x10,
+			target:   0x1000 - 4,
+			expected: []byte{0xec, 0x0f, 0x00, 0x00},
+		},
+		{
+			name:     "REX_GOTPCRELX overflow",
+			relaType: elf.R_X86_64_REX_GOTPCRELX,
+			offset:   0x10,
+			target:   -(1 << 32),
+			err:      "overflows",
+		},
+		{
+			name:     "64",
+			relaType: elf.R_X86_64_64,
+			offset:   0x10,
+			target:   0x1008,
+			expected: []byte{0x08, 0x10, 0x00, 0x00, 0x00, 0x7f, 0x00, 0x00},
+		},
+		{
+			name:     "PC64",
+			relaType: elf.R_X86_64_PC64,
+			offset:   0x10,
+			target:   0x8,
+			expected: []byte{0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		},
+		{
+			name:     "out of image",
+			relaType: elf.R_X86_64_PC32,
+			offset:   0x1e,
+			target:   0,
+			err:      "out of the image",
+		},
+		{
+			name:     "not supported",
+			relaType: elf.R_X86_64_GOTOFF64,
+			offset:   0x10,
+			target:   0,
+			err:      "not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, 0x20)
+			r := imageRelocation{relaType: uint32(tt.relaType), offset: tt.offset, target: tt.target, symbol: "TV_SEC_DELTA"}
+			err := applyRelocation(content, r, base)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error is %v, expected %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := content[tt.offset : tt.offset+uint64(len(tt.expected))]
+			if !bytes.Equal(written, tt.expected) {
+				t.Fatalf("wrote % x, expected % x", written, tt.expected)
+			}
+		})
+	}
+}
+
+// TestLoadSampleImages loads the objects of test/images, which are built with
+// the flags in their names and committed by make -C test update-samples
+func TestLoadSampleImages(t *testing.T) {
+	const base = uint64(linkTestBase)
+	tests := []struct {
+		path string
+		// hook is the offset of fake_gettimeofday in the image, the entry stub
+		// jumps to it if it is not 0
+		hook uint64
+		// gotSlots is the number of the variables accessed through GOT
+		gotSlots int
+	}{
+		{path: "test/images/fake_gettimeofday_O0_amd64.o"},
+		{path: "test/images/fake_gettimeofday_Os_amd64.o", hook: uint64(len(entryStub)) + 0x1c},
+		{path: "test/images/fake_gettimeofday_O2_pic_amd64.o", hook: uint64(len(entryStub)) + 0x20, gotSlots: 2},
+		{path: "test/images/fake_gettimeofday_O2_pie_amd64.o", hook: uint64(len(entryStub)) + 0x20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			image, err := LoadFakeImageFromFile(tt.path, getTimeOfDay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"TV_SEC_DELTA", "FAKE_MODE"} {
+				if _, ok := image.offset[name]; !ok {
+					t.Errorf("variable %s is not in the image", name)
+				}
+			}
+			if image.dataOffset == 0 || (fakeImageHeaderSize+image.dataOffset)%uint64(os.Getpagesize()) != 0 {
+				t.Errorf("writable part at %#x is not at a page of the mapping", image.dataOffset)
+			}
+
+			content, err := image.link(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.hook == 0 {
+				if content[0] == entryStub[0] {
+					t.Errorf("image begins with the entry stub, expected the hook")
+				}
+			} else {
+				if content[0] != entryStub[0] {
+					t.Fatalf("image begins with %#x, expected the entry stub", content[0])
+				}
+				// jmp rel32 is relative to the end of the instruction
+				jump := int64(int32(endian.Uint32(content[entryStubOffset:]))) + entryStubOffset + 4
+				if uint64(jump) != tt.hook {
+					t.Errorf("entry stub jumps to %#x, expected %#x", jump, tt.hook)
+				}
+			}
+
+			slots := 0
+			for _, r := range image.relocations {
+				if r.relaType != absRelocation {
+					continue
+				}
+				slots++
+				if r.offset < image.dataOffset || r.offset%pointerLength != 0 {
+					t.Errorf("GOT slot of %s at %#x is not an aligned writable slot", r.symbol, r.offset)
+				}
+				if address := endian.Uint64(content[r.offset:]); address != base+uint64(image.offset[r.symbol]) {
+					t.Errorf("GOT slot of %s holds %#x, expected %#x", r.symbol, address, base+uint64(image.offset[r.symbol]))
+				}
+			}
+			if slots != tt.gotSlots {
+				t.Errorf("image has %d GOT slots, expected %d", slots, tt.gotSlots)
+			}
+		})
+	}
+}
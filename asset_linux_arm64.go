@@ -3,54 +3,173 @@ package watchmaker
 import (
 	"debug/elf"
 	"embed"
-	"encoding/binary"
+	"fmt"
 )
 
 //go:embed fakeclock/*_arm64.o
 var fakeclock embed.FS
 
-func AssetLD(rela elf.Rela64, imageOffset map[string]int, imageContent *[]byte, sym elf.Symbol, byteorder binary.ByteOrder) {
-	imageOffset[sym.Name] = len(*imageContent)
-
-	targetOffset := uint32(len(*imageContent)) - uint32(rela.Off) + uint32(rela.Addend)
-
-	// The relocation of a aarch64 image is like:
-	// Offset          Info           Type           Sym. Value    Sym. Name + Addend
-	// 000000000010  000b00000135 R_AARCH64_GOT_LD_ 0000000000000000 CLOCK_IDS_MASK + 0
-	// 00000000002c  000c00000135 R_AARCH64_GOT_LD_ 0000000000000000 TV_NSEC_DELTA + 0
-	// 000000000034  000d00000135 R_AARCH64_GOT_LD_ 0000000000000000 TV_SEC_DELTA + 0
-
-	// we assume the type is always R_AARCH64_GOT_LD_PREL19, with `-mcmodel=tiny`
-
-	// In this situation, we need to push two uint64 to the end:
-	// One for the location of variable, and one for the variable
-
-	// For example, if the entry starts at 0x00, and we have two variables whose value are
-	// 0xFF and 0xFE. We will have 32 bytes after the content:
-	// | 0x00 | 0x08 | 0x10 | 0x18 |
-	// | 0x08 | 0xFF | 0x18 | 0xFE |
-
-	// See the manual of LDR (literal) and LDR (register) to understand the
-	// relocation based on the following assemblies:
-	//
-	// ldr x1, #OFFSET_OF_ADDR ; in this step, the address of variable is loaded
-	//                           into the x1 register
-	// ldr x1, [x1]            ; in this step, the variable itself is loaded into
-	//                           the register
-
-	targetOffset >>= 2
-	instr := byteorder.Uint32((*imageContent)[rela.Off : rela.Off+4])
-
-	// See the document of instruction
-	// [ldr](https://developer.arm.com/documentation/ddi0596/2021-12/Base-Instructions/LDR--literal---Load-Register--literal--?lang=en)
-	// the offset is saved in `imm19`, and the max length is 19 (bit)
-	//
-	// 1. cut `instr` at [0:4] and [23:31]
-	// 2. cut the little 19 bit of `targetOffset`, and shift it to [5:23]
-	// 3. concat them
-	instr = uint32(int(instr) & ^((1<<19-1)<<5)) | ((targetOffset & (1<<19 - 1)) << 5)
-	byteorder.PutUint32((*imageContent)[rela.Off:rela.Off+4], instr)
-
-	// TODO: support other length besides uint64 (which is 8 bytes)
-	*imageContent = append(*imageContent, make([]byte, varLength)...)
+// elfMachine is the machine of the fake images
+const elfMachine = elf.EM_AARCH64
+
+// absRelocation fills a GOT slot with the address of the symbol
+const absRelocation = uint32(elf.R_AARCH64_ABS64)
+
+// relocationClasses are the supported relocations. The relocation of a aarch64
+// image built with `-mcmodel=tiny` is like:
+//
+//	Offset          Info           Type           Sym. Value    Sym. Name + Addend
+//	000000000010  000b00000135 R_AARCH64_GOT_LD_ 0000000000000000 CLOCK_IDS_MASK + 0
+//	00000000002c  000c00000135 R_AARCH64_GOT_LD_ 0000000000000000 TV_NSEC_DELTA + 0
+//	000000000034  000d00000135 R_AARCH64_GOT_LD_ 0000000000000000 TV_SEC_DELTA + 0
+//
+// which loads the address of variable from a GOT slot first:
+//
+//	ldr x1, #OFFSET_OF_SLOT ; in this step, the address of variable is loaded
+//	                          into the x1 register
+//	ldr x1, [x1]            ; in this step, the variable itself is loaded into
+//	                          the register
+//
+// The default small code model uses pairs of adrp and add/ldr instead, e.g.
+// R_AARCH64_ADR_PREL_PG_HI21 and R_AARCH64_ADD_ABS_LO12_NC.
+var relocationClasses = map[uint32]relocationClass{
+	uint32(elf.R_AARCH64_ABS64):               relocDirect,
+	uint32(elf.R_AARCH64_PREL64):              relocDirect,
+	uint32(elf.R_AARCH64_PREL32):              relocDirect,
+	uint32(elf.R_AARCH64_ADR_PREL_LO21):       relocDirect,
+	uint32(elf.R_AARCH64_ADR_PREL_PG_HI21):    relocDirect,
+	uint32(elf.R_AARCH64_ADR_PREL_PG_HI21_NC): relocDirect,
+	uint32(elf.R_AARCH64_ADD_ABS_LO12_NC):     relocDirect,
+	uint32(elf.R_AARCH64_LDST8_ABS_LO12_NC):   relocDirect,
+	uint32(elf.R_AARCH64_LDST16_ABS_LO12_NC):  relocDirect,
+	uint32(elf.R_AARCH64_LDST32_ABS_LO12_NC):  relocDirect,
+	uint32(elf.R_AARCH64_LDST64_ABS_LO12_NC):  relocDirect,
+	uint32(elf.R_AARCH64_LDST128_ABS_LO12_NC): relocDirect,
+	uint32(elf.R_AARCH64_LD_PREL_LO19):        relocDirect,
+	uint32(elf.R_AARCH64_CONDBR19):            relocCall,
+	uint32(elf.R_AARCH64_TSTBR14):             relocCall,
+	uint32(elf.R_AARCH64_JUMP26):              relocCall,
+	uint32(elf.R_AARCH64_CALL26):              relocCall,
+	uint32(elf.R_AARCH64_GOT_LD_PREL19):       relocGOT,
+	uint32(elf.R_AARCH64_ADR_GOT_PAGE):        relocGOT,
+	uint32(elf.R_AARCH64_LD64_GOT_LO12_NC):    relocGOT,
+}
+
+func relocationName(relaType uint32) string {
+	return elf.R_AARCH64(relaType).String()
+}
+
+// page returns the 4KB page of addr, which adrp refers to
+func page(addr uint64) uint64 {
+	return addr &^ 0xfff
+}
+
+// applyRelocation writes the relocation r to content mapped at base. The
+// immediate of the instruction is replaced, see the documents of the
+// instructions, e.g. the offset of ldr (literal) is saved in `imm19` at [5:23].
+// The GOT slots are within the image, so they are relocated the same as the
+// variables.
+func applyRelocation(content []byte, r imageRelocation, base uint64) error {
+	place := base + r.offset
+	value := uint64(int64(base) + r.target)
+	rel := int64(value - place)
+	relaType := elf.R_AARCH64(r.relaType)
+
+	length := uint64(4)
+	if relaType == elf.R_AARCH64_ABS64 || relaType == elf.R_AARCH64_PREL64 {
+		length = 8
+	}
+	if r.offset+length > uint64(len(content)) {
+		return fmt.Errorf("relocation %s at %#x against %s is out of the image", relocationName(r.relaType), r.offset, r.symbol)
+	}
+	overflow := fmt.Errorf("relocation %s at %#x against %s overflows", relocationName(r.relaType), r.offset, r.symbol)
+	instr := endian.Uint32(content[r.offset:])
+
+	switch relaType {
+	case elf.R_AARCH64_ABS64:
+		endian.PutUint64(content[r.offset:], value)
+		return nil
+	case elf.R_AARCH64_PREL64:
+		endian.PutUint64(content[r.offset:], uint64(rel))
+		return nil
+	case elf.R_AARCH64_PREL32:
+		if !fitsSigned(rel, 32) {
+			return overflow
+		}
+		endian.PutUint32(content[r.offset:], uint32(rel))
+		return nil
+	case elf.R_AARCH64_ADR_PREL_LO21:
+		if !fitsSigned(rel, 21) {
+			return overflow
+		}
+		instr = setAdrImmediate(instr, rel)
+	case elf.R_AARCH64_ADR_PREL_PG_HI21, elf.R_AARCH64_ADR_PREL_PG_HI21_NC, elf.R_AARCH64_ADR_GOT_PAGE:
+		pages := int64(page(value)-page(place)) >> 12
+		if relaType != elf.R_AARCH64_ADR_PREL_PG_HI21_NC && !fitsSigned(pages, 21) {
+			return overflow
+		}
+		instr = setAdrImmediate(instr, pages)
+	case elf.R_AARCH64_ADD_ABS_LO12_NC:
+		instr = setImmediate(instr, value&0xfff, 10, 12)
+	case elf.R_AARCH64_LDST8_ABS_LO12_NC, elf.R_AARCH64_LDST16_ABS_LO12_NC, elf.R_AARCH64_LDST32_ABS_LO12_NC,
+		elf.R_AARCH64_LDST64_ABS_LO12_NC, elf.R_AARCH64_LDST128_ABS_LO12_NC, elf.R_AARCH64_LD64_GOT_LO12_NC:
+		scale := map[elf.R_AARCH64]uint{
+			elf.R_AARCH64_LDST8_ABS_LO12_NC:   0,
+			elf.R_AARCH64_LDST16_ABS_LO12_NC:  1,
+			elf.R_AARCH64_LDST32_ABS_LO12_NC:  2,
+			elf.R_AARCH64_LDST64_ABS_LO12_NC:  3,
+			elf.R_AARCH64_LDST128_ABS_LO12_NC: 4,
+			elf.R_AARCH64_LD64_GOT_LO12_NC:    3,
+		}[relaType]
+		if value&(1<<scale-1) != 0 {
+			return fmt.Errorf("relocation %s at %#x against %s is not aligned", relocationName(r.relaType), r.offset, r.symbol)
+		}
+		instr = setImmediate(instr, (value&0xfff)>>scale, 10, 12)
+	case elf.R_AARCH64_LD_PREL_LO19, elf.R_AARCH64_GOT_LD_PREL19, elf.R_AARCH64_CONDBR19:
+		if rel%4 != 0 || !fitsSigned(rel, 21) {
+			return overflow
+		}
+		instr = setImmediate(instr, uint64(rel>>2), 5, 19)
+	case elf.R_AARCH64_TSTBR14:
+		if rel%4 != 0 || !fitsSigned(rel, 16) {
+			return overflow
+		}
+		instr = setImmediate(instr, uint64(rel>>2), 5, 14)
+	case elf.R_AARCH64_JUMP26, elf.R_AARCH64_CALL26:
+		if rel%4 != 0 || !fitsSigned(rel, 28) {
+			return overflow
+		}
+		instr = setImmediate(instr, uint64(rel>>2), 0, 26)
+	default:
+		return fmt.Errorf("relocation %s at %#x against %s is not supported", relocationName(r.relaType), r.offset, r.symbol)
+	}
+	endian.PutUint32(content[r.offset:], instr)
+	return nil
 }
+
+// fitsSigned returns true if v fits in a signed integer of bits
+func fitsSigned(v int64, bits uint) bool {
+	return v >= -(1<<(bits-1)) && v < 1<<(bits-1)
+}
+
+// setImmediate replaces the bits [shift:shift+bits] of instr with the low bits of imm
+func setImmediate(instr uint32, imm uint64, shift uint, bits uint) uint32 {
+	mask := uint32(1<<bits-1) << shift
+	return instr&^mask | uint32(imm<<shift)&mask
+}
+
+// setAdrImmediate replaces the immediate of adr and adrp, which is split to
+// immlo at [29:31] and immhi at [5:24]
+func setAdrImmediate(instr uint32, imm int64) uint32 {
+	instr = setImmediate(instr, uint64(imm)&0x3, 29, 2)
+	return setImmediate(instr, uint64(imm)>>2, 5, 19)
+}
+
+// entryStub is `b` to the hook function, see loadFakeImage
+var entryStub = []byte{0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x20, 0xd4, 0x00, 0x00, 0x20, 0xd4, 0x00, 0x00, 0x20, 0xd4}
+
+const (
+	entryStubRelocation = uint32(elf.R_AARCH64_JUMP26)
+	entryStubOffset     = 0
+	entryStubAddend     = 0
+)
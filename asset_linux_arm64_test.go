@@ -0,0 +1,172 @@
+package watchmaker
+
+import (
+	"debug/elf"
+	"strings"
+	"testing"
+)
+
+// relocationTest applies a relocation to instr at offset of an image mapped at
+// base, the immediate of the instruction is compared with expected
+type relocationTest struct {
+	name     string
+	relaType elf.R_AARCH64
+	instr    uint32
+	offset   uint64
+	target   int64
+	expected int64
+	err      string
+}
+
+// testBase is a page of the image, so the low 12 bits of a target are the ones of
+// its address
+const testBase = uint64(0x7f0000000000)
+
+// signExtend returns the low bits of v as a signed integer
+func signExtend(v uint64, bits uint) int64 {
+	return int64(v<<(64-bits)) >> (64 - bits)
+}
+
+// runRelocationTests applies the relocations, immediate decodes the immediate
+// of the relocated instruction and mask is the bits of the immediate, the other
+// bits must be kept
+func runRelocationTests(t *testing.T, tests []relocationTest, immediate func(uint32) int64, mask uint32) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, 0x2000)
+			endian.PutUint32(content[tt.offset:], tt.instr)
+			r := imageRelocation{relaType: uint32(tt.relaType), offset: tt.offset, target: tt.target, symbol: "TV_SEC_DELTA"}
+			err := applyRelocation(content, r, testBase)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error is %v, expected %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			instr := endian.Uint32(content[tt.offset:])
+			if instr&^mask != tt.instr&^mask {
+				t.Fatalf("instruction is %#08x, the opcode of %#08x is not kept", instr, tt.instr)
+			}
+			if imm := immediate(instr); imm != tt.expected {
+				t.Fatalf("immediate is %#x, expected %#x", imm, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyAdrpRelocation(t *testing.T) {
+	// adrp x0, 0
+	const adrp = uint32(0x90000000)
+	tests := []relocationTest{
+		{name: "same page", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: 0x800, expected: 0},
+		{name: "next page", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0xffc, target: 0x1000, expected: 1},
+		{name: "end of page", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x1000, target: 0x1fff, expected: 0},
+		{name: "immhi", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: 0x5010, expected: 5},
+		{name: "previous page", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x1000, target: 0xfff, expected: -1},
+		{name: "max", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: 1<<32 - 0x1000, expected: 1<<20 - 1},
+		{name: "min", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: -(1 << 32), expected: -(1 << 20)},
+		{name: "overflow", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: 1 << 32, err: "overflows"},
+		{name: "underflow", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21, instr: adrp, offset: 0x10, target: -(1 << 32) - 0x1000, err: "overflows"},
+		{name: "NC doesn't overflow", relaType: elf.R_AARCH64_ADR_PREL_PG_HI21_NC, instr: adrp, offset: 0x10, target: 1 << 32, expected: -(1 << 20)},
+		// adrp x1, 0
+		{name: "GOT page", relaType: elf.R_AARCH64_ADR_GOT_PAGE, instr: adrp | 1, offset: 0x10, target: 0x1008, expected: 1},
+	}
+	immediate := func(instr uint32) int64 {
+		immlo := uint64(instr>>29) & 0x3
+		immhi := uint64(instr>>5) & 0x7ffff
+		return signExtend(immhi<<2|immlo, 21)
+	}
+	runRelocationTests(t, tests, immediate, 0x3<<29|0x7ffff<<5)
+}
+
+func TestApplyLoadStoreRelocation(t *testing.T) {
+	// ldrb w0, [x1]; ldrh w0, [x1]; ldr w0, [x1]; ldr x0, [x1]; ldr q0, [x1]
+	const (
+		ldrb  = uint32(0x39400020)
+		ldrh  = uint32(0x79400020)
+		ldrw  = uint32(0xb9400020)
+		ldrx  = uint32(0xf9400020)
+		ldrq  = uint32(0x3dc00020)
+		addlo = uint32(0x91000020)
+	)
+	tests := []relocationTest{
+		{name: "ADD", relaType: elf.R_AARCH64_ADD_ABS_LO12_NC, instr: addlo, offset: 0x10, target: 0x1233, expected: 0x233},
+		{name: "LDST8", relaType: elf.R_AARCH64_LDST8_ABS_LO12_NC, instr: ldrb, offset: 0x10, target: 0x1233, expected: 0x233},
+		{name: "LDST16", relaType: elf.R_AARCH64_LDST16_ABS_LO12_NC, instr: ldrh, offset: 0x10, target: 0x1232, expected: 0x119},
+		{name: "LDST16 unaligned", relaType: elf.R_AARCH64_LDST16_ABS_LO12_NC, instr: ldrh, offset: 0x10, target: 0x1233, err: "not aligned"},
+		{name: "LDST32", relaType: elf.R_AARCH64_LDST32_ABS_LO12_NC, instr: ldrw, offset: 0x10, target: 0x1234, expected: 0x8d},
+		{name: "LDST32 unaligned", relaType: elf.R_AARCH64_LDST32_ABS_LO12_NC, instr: ldrw, offset: 0x10, target: 0x1232, err: "not aligned"},
+		{name: "LDST64", relaType: elf.R_AARCH64_LDST64_ABS_LO12_NC, instr: ldrx, offset: 0x10, target: 0x1ff8, expected: 0x1ff},
+		{name: "LDST64 unaligned", relaType: elf.R_AARCH64_LDST64_ABS_LO12_NC, instr: ldrx, offset: 0x10, target: 0x1234, err: "not aligned"},
+		{name: "LDST128", relaType: elf.R_AARCH64_LDST128_ABS_LO12_NC, instr: ldrq, offset: 0x10, target: 0x1230, expected: 0x23},
+		{name: "LDST128 unaligned", relaType: elf.R_AARCH64_LDST128_ABS_LO12_NC, instr: ldrq, offset: 0x10, target: 0x1238, err: "not aligned"},
+		{name: "GOT slot", relaType: elf.R_AARCH64_LD64_GOT_LO12_NC, instr: ldrx, offset: 0x10, target: 0x1010, expected: 0x2},
+		{name: "GOT slot unaligned", relaType: elf.R_AARCH64_LD64_GOT_LO12_NC, instr: ldrx, offset: 0x10, target: 0x1014, err: "not aligned"},
+	}
+	immediate := func(instr uint32) int64 {
+		return int64(instr>>10) & 0xfff
+	}
+	runRelocationTests(t, tests, immediate, 0xfff<<10)
+}
+
+func TestApplyBranchRelocation(t *testing.T) {
+	// bl 0; b 0
+	const (
+		bl = uint32(0x94000000)
+		b  = uint32(0x14000000)
+	)
+	tests := []relocationTest{
+		{name: "forward", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x110, expected: 0x100},
+		{name: "backward", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0, expected: -0x10},
+		{name: "max", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x10 + 1<<27 - 4, expected: 1<<27 - 4},
+		{name: "min", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x10 - 1<<27, expected: -(1 << 27)},
+		{name: "overflow", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x10 + 1<<27, err: "overflows"},
+		{name: "underflow", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x10 - 1<<27 - 4, err: "overflows"},
+		{name: "unaligned", relaType: elf.R_AARCH64_CALL26, instr: bl, offset: 0x10, target: 0x112, err: "overflows"},
+		{name: "JUMP26", relaType: elf.R_AARCH64_JUMP26, instr: b, offset: 0x100, target: 0x40, expected: -0xc0},
+	}
+	immediate := func(instr uint32) int64 {
+		return signExtend(uint64(instr&0x3ffffff), 26) * 4
+	}
+	runRelocationTests(t, tests, immediate, 0x3ffffff)
+}
+
+func TestApplyRelocationOutOfImage(t *testing.T) {
+	content := make([]byte, 0x10)
+	for _, relaType := range []elf.R_AARCH64{elf.R_AARCH64_CALL26, elf.R_AARCH64_ABS64} {
+		r := imageRelocation{relaType: uint32(relaType), offset: 0xe, target: 0, symbol: "TV_SEC_DELTA"}
+		err := applyRelocation(content, r, testBase)
+		if err == nil || !strings.Contains(err.Error(), "out of the image") {
+			t.Errorf("error of %s is %v, expected out of the image", relaType, err)
+		}
+	}
+}
+
+// TestEntryStub links the entry stub like loadFakeImage, when the hook is not
+// at the beginning of .text
+func TestEntryStub(t *testing.T) {
+	const hook = 0x30
+	content := append(append([]byte(nil), entryStub...), make([]byte, 0x40)...)
+	image := NewFakeImage(getTimeOfDay, content, map[string]int{})
+	image.relocations = []imageRelocation{{
+		relaType: entryStubRelocation,
+		offset:   entryStubOffset,
+		target:   int64(len(entryStub)+hook) + entryStubAddend,
+		symbol:   "fake_gettimeofday",
+	}}
+	linked, err := image.link(testBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instr := endian.Uint32(linked[entryStubOffset:])
+	if instr&^0x3ffffff != 0x14000000 {
+		t.Fatalf("entry stub is %#08x, expected b", instr)
+	}
+	jump := signExtend(uint64(instr&0x3ffffff), 26)*4 + entryStubOffset
+	if jump != int64(len(entryStub)+hook) {
+		t.Fatalf("entry stub jumps to %#x, expected %#x", jump, len(entryStub)+hook)
+	}
+}
@@ -0,0 +1,50 @@
+package watchmaker
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestGotSlot(t *testing.T) {
+	l := &imageLoader{
+		path:    "test.o",
+		content: make([]byte, 13),
+		got:     make(map[int64]uint64),
+	}
+
+	first := l.gotSlot(0x40, "TV_SEC_DELTA")
+	if first != 16 {
+		t.Fatalf("first slot is at %#x, expected %#x after aligning content", first, 16)
+	}
+	if again := l.gotSlot(0x40, "TV_SEC_DELTA"); again != first {
+		t.Fatalf("slot of the same symbol is at %#x, expected %#x", again, first)
+	}
+	second := l.gotSlot(0x48, "TV_NSEC_DELTA")
+	if second != first+pointerLength {
+		t.Fatalf("second slot is at %#x, expected %#x", second, first+pointerLength)
+	}
+	if len(l.content) != int(second+pointerLength) {
+		t.Fatalf("content has %d bytes, expected %d", len(l.content), second+pointerLength)
+	}
+
+	expected := []imageRelocation{
+		{relaType: absRelocation, offset: first, target: 0x40, symbol: "TV_SEC_DELTA"},
+		{relaType: absRelocation, offset: second, target: 0x48, symbol: "TV_NSEC_DELTA"},
+	}
+	if len(l.relocations) != len(expected) {
+		t.Fatalf("got %d relocations, expected %d", len(l.relocations), len(expected))
+	}
+	for i, r := range l.relocations {
+		if r != expected[i] {
+			t.Errorf("relocation %d is %+v, expected %+v", i, r, expected[i])
+		}
+	}
+}
+
+func TestLoadFakeImageFromMissingFile(t *testing.T) {
+	_, err := LoadFakeImageFromFile("test/images/missing.o", getTimeOfDay)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("error is %v, expected %v", err, fs.ErrNotExist)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultCgroupPrefix is where cgroup v2 is mounted
+const DefaultCgroupPrefix = "/sys/fs/cgroup"
+
+// cgroupRoot returns the root of the cgroup v2 hierarchy. On hybrid hosts the
+// unified hierarchy is mounted at /sys/fs/cgroup/unified, and systemd v1
+// hierarchy at /sys/fs/cgroup/systemd.
+func cgroupRoot() (string, error) {
+	for _, root := range []string{
+		DefaultCgroupPrefix,
+		filepath.Join(DefaultCgroupPrefix, "unified"),
+		filepath.Join(DefaultCgroupPrefix, "systemd"),
+	} {
+		if _, err := os.Stat(filepath.Join(root, "cgroup.procs")); err == nil {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("cgroup hierarchy is not found in %s", DefaultCgroupPrefix)
+}
+
+// resolveCgroup returns the directory of --cgroup, which could be the full path
+// or the path relative to the cgroup root
+func resolveCgroup(path string) (string, error) {
+	if _, err := os.Stat(filepath.Join(path, "cgroup.procs")); err == nil {
+		return path, nil
+	}
+	root, err := cgroupRoot()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, path)
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.procs")); err != nil {
+		return "", fmt.Errorf("%s is not a cgroup", path)
+	}
+	return dir, nil
+}
+
+// unitCgroup returns the cgroup directory of a systemd unit
+func unitCgroup(unit string) (string, error) {
+	if !strings.Contains(unit, ".") {
+		unit += ".service"
+	}
+	out, err := exec.Command("systemctl", "show", "--property", "ControlGroup", "--value", unit).Output()
+	if err != nil {
+		return "", fmt.Errorf("%v get cgroup of unit %s", err, unit)
+	}
+	controlGroup := strings.TrimSpace(string(out))
+	if controlGroup == "" {
+		return "", fmt.Errorf("unit %s is not running", unit)
+	}
+	return resolveCgroup(controlGroup)
+}
+
+// cgroupProcesses returns the pids in cgroup.procs of dir and all its sub-cgroups
+func cgroupProcesses(dir string) (map[uint64]bool, error) {
+	pids := make(map[uint64]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		procs, err := os.Open(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			// the sub-cgroup may be removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer procs.Close()
+
+		scanner := bufio.NewScanner(procs)
+		for scanner.Scan() {
+			_pid, err := strconv.ParseUint(strings.TrimSpace(scanner.Text()), 10, 64)
+			if err != nil {
+				continue
+			}
+			pids[_pid] = true
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v read processes of cgroup %s", err, dir)
+	}
+	return pids, nil
+}
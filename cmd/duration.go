@@ -0,0 +1,70 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// recoverAfter waits until duration passes or a signal is received, then recovers
+// every injected or failed process. Processes which have exited are skipped. A
+// zero duration waits for the signal only.
+func recoverAfter(duration time.Duration, signals <-chan os.Signal, skew *watchmaker.Skew,
+	injected map[uint64]*watchmaker.Skew, failed map[uint64]error) {
+	var expired <-chan time.Time
+	if duration > 0 {
+		slog.Info("recovering time later", "duration", duration)
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		expired = timer.C
+	} else {
+		slog.Info("recovering time on signal")
+	}
+	select {
+	case <-expired:
+		slog.Info("duration expired")
+	case sig := <-signals:
+		slog.Info("received signal", "signal", sig)
+	}
+	recoverProcesses(skew, injected, failed)
+}
+
+// recoverProcesses recovers every injected process, and the failed ones by forks
+// of skew, as a failed Inject may leave some of the images injected. Recover does
+// nothing to the images not injected. Processes which have exited are skipped.
+func recoverProcesses(skew *watchmaker.Skew, injected map[uint64]*watchmaker.Skew, failed map[uint64]error) {
+	skews := make(map[uint64]*watchmaker.Skew, len(injected)+len(failed))
+	for _pid := range failed {
+		s, err := skew.Fork()
+		if err != nil {
+			slog.Warn("fork skew failed", "pid", _pid, "error", err)
+			continue
+		}
+		skews[_pid] = s
+	}
+	for _pid, s := range injected {
+		skews[_pid] = s
+	}
+
+	for _, _pid := range sortedPids(skews) {
+		if !watchmaker.ProcessExists(int(_pid)) {
+			slog.Info("process exited, skip recovering", "pid", _pid)
+			continue
+		}
+		slog.Info("recovering time", "pid", _pid)
+		err := skews[_pid].Recover(_pid)
+		if err != nil {
+			if !watchmaker.ProcessExists(int(_pid)) {
+				slog.Info("process exited while recovering", "pid", _pid)
+				continue
+			}
+			slog.Warn("recover time failed", "pid", _pid, "error", err)
+			continue
+		}
+		slog.Info("recovering time success", "pid", _pid)
+	}
+}
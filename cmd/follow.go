@@ -0,0 +1,132 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// followProcesses polls /proc every interval, injects every new descendant of the
+// injected processes, and injects again the processes which have lost the fake
+// images by exec. It stops when duration passes (if duration is not zero), a
+// signal is received or all followed processes have exited, then recovers every
+// process still alive, including the ones failed to be modified.
+func followProcesses(skew *watchmaker.Skew, injected map[uint64]*watchmaker.Skew, failed map[uint64]error,
+	interval time.Duration, duration time.Duration, signals <-chan os.Signal) {
+	var expired <-chan time.Time
+	if duration > 0 {
+		slog.Info("following children, recovering time later", "duration", duration)
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		expired = timer.C
+	} else {
+		slog.Info("following children until signal")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-expired:
+			slog.Info("duration expired")
+			recoverProcesses(skew, injected, failed)
+			return
+		case sig := <-signals:
+			slog.Info("received signal", "signal", sig)
+			recoverProcesses(skew, injected, failed)
+			return
+		case <-ticker.C:
+		}
+
+		if !followOnce(skew, injected, failed) {
+			slog.Info("all followed processes exited")
+			return
+		}
+	}
+}
+
+// followOnce does one round of following, it returns false if no followed process
+// is alive.
+func followOnce(skew *watchmaker.Skew, injected map[uint64]*watchmaker.Skew, failed map[uint64]error) bool {
+	infos, err := listProcesses()
+	if err != nil {
+		slog.Warn("list processes failed", "error", err)
+		return true
+	}
+	alive := make(map[uint64]bool, len(infos))
+	pidMap := make(map[uint64][]uint64)
+	for _, info := range infos {
+		alive[info.pid] = true
+		pidMap[info.ppid] = append(pidMap[info.ppid], info.pid)
+	}
+
+	// forget the exited processes, as their pids may be reused
+	for _, _pid := range sortedPids(injected) {
+		if !alive[_pid] || !watchmaker.ProcessExists(int(_pid)) {
+			slog.Info("followed process exited", "pid", _pid)
+			delete(injected, _pid)
+		}
+	}
+	for _pid := range failed {
+		if !alive[_pid] {
+			delete(failed, _pid)
+		}
+	}
+	if len(injected) == 0 {
+		return false
+	}
+
+	// a process loses the fake images after exec, as the kernel maps a fresh vDSO
+	for _, _pid := range sortedPids(injected) {
+		ok, err := injected[_pid].Injected(_pid)
+		if err != nil || ok {
+			continue
+		}
+		slog.Info("process executed a new program, modifying time again", "pid", _pid)
+		err = injected[_pid].Inject(_pid)
+		if err != nil {
+			slog.Warn("modify time failed", "pid", _pid, "error", err)
+			failed[_pid] = err
+			delete(injected, _pid)
+			continue
+		}
+		slog.Info("modifying time success")
+	}
+
+	// children are reparented after their parent exits, so they are collected
+	// from every injected process rather than the selected ones
+	var children []uint64
+	for _, _pid := range sortedPids(injected) {
+		for _, child := range collectAllChildren(_pid, pidMap) {
+			if _, ok := injected[child]; ok {
+				continue
+			}
+			if _, ok := failed[child]; ok {
+				continue
+			}
+			children = append(children, child)
+		}
+	}
+	for _, child := range children {
+		if _, ok := injected[child]; ok {
+			continue
+		}
+		slog.Info("modifying new child time", "pid", child)
+		s, err := skew.Fork()
+		if err == nil {
+			err = s.Inject(child)
+		}
+		if err != nil {
+			slog.Warn("modify time failed", "pid", child, "error", err)
+			failed[child] = err
+			continue
+		}
+		injected[child] = s
+		slog.Info("modifying time success")
+	}
+	return true
+}
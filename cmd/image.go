@@ -0,0 +1,59 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// imageFlags is the value of --image symbol=path.o, which may be repeated to
+// replace or add more than one vDSO symbol
+type imageFlags []imageFlag
+
+type imageFlag struct {
+	symbol string
+	path   string
+}
+
+func (f *imageFlags) String() string {
+	var images []string
+	for _, image := range *f {
+		images = append(images, image.symbol+"="+image.path)
+	}
+	return strings.Join(images, ",")
+}
+
+func (f *imageFlags) Set(value string) error {
+	symbol, path, ok := strings.Cut(value, "=")
+	if !ok || symbol == "" || path == "" {
+		return fmt.Errorf("invalid image %s, expected symbol=path.o", value)
+	}
+	*f = append(*f, imageFlag{symbol: symbol, path: path})
+	return nil
+}
+
+// imageUsage is the usage of --image shared by the subcommands
+const imageUsage = "fake image to replace a vDSO symbol with, symbol=path.o, e.g. clock_gettime=my_clock_gettime.o, may be repeated. " +
+	"The same images must be given to update, recover needs only the symbols not replaced by default"
+
+// stopModeUsage is the usage of --stop-mode
+const stopModeUsage = "threads stopped while injecting, all stops every thread, minimal stops only the main thread " +
+	"except while the jumps are written into vDSO, which pauses processes with many threads for shorter"
+
+// setImages loads the fake images from the files and sets them to skew
+func setImages(skew *watchmaker.Skew, images imageFlags) error {
+	for _, image := range images {
+		fakeImage, err := watchmaker.LoadFakeImageFromFile(image.path, image.symbol)
+		if err != nil {
+			return err
+		}
+		err = skew.SetImage(fakeImage)
+		if err != nil {
+			return fmt.Errorf("%v, image: %s", err, image.path)
+		}
+	}
+	return nil
+}
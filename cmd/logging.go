@@ -0,0 +1,57 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// logFlags are --log-level and --log-format shared by the subcommands
+type logFlags struct {
+	level  string
+	format string
+}
+
+// register adds the flags to fs
+func (f *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.level, "log-level", "warn", "level of the logs written to stderr, debug, info, warn or error")
+	fs.StringVar(&f.format, "log-format", "text", "format of the logs, text or json")
+}
+
+// setup sets the default logger and the logger of watchmaker from the flags,
+// it must be called after the flags are parsed
+func (f *logFlags) setup() error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(f.level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %s, expected debug, info, warn or error", f.level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(f.format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %s, expected text or json", f.format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	watchmaker.SetLogger(logger)
+	return nil
+}
+
+// fatal logs v at error level, which is never filtered, and exits
+func fatal(v ...any) {
+	slog.Error(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	os.Exit(1)
+}
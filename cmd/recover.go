@@ -0,0 +1,74 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// recoverMain restores the real time of a process injected by any watchmaker run
+func recoverMain(args []string) {
+	var (
+		recoverPid    uint64
+		recursive     bool
+		recoverImages imageFlags
+	)
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	fs.Uint64Var(&recoverPid, "pid", 0, "pid of target program")
+	fs.BoolVar(&recursive, "recursive", false, "recover child processes too")
+	fs.Var(&recoverImages, "image", imageUsage)
+	var logging logFlags
+	logging.register(fs)
+	_ = fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fatal(err)
+	}
+
+	if recoverPid <= 0 {
+		fatal("pid can't is zero")
+	}
+	slog.Info("recovering time", "pid", recoverPid, "recursive", recursive)
+
+	skew, err := watchmaker.GetSkew(watchmaker.NewConfig(0, 0, 0))
+	if err != nil {
+		fatal(err)
+	}
+	err = setImages(skew, recoverImages)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("recovering time", "pid", recoverPid)
+	err = skew.Recover(recoverPid)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("recovering time success")
+
+	if !recursive {
+		return
+	}
+	childPIDs, err := getChildProcesses(recoverPid)
+	if err != nil {
+		fatal(err)
+	}
+	if len(childPIDs) == 0 {
+		return
+	}
+	slog.Info("recovering child time", "pids", childPIDs)
+	for _, _childPid := range childPIDs {
+		var skewFork *watchmaker.Skew
+		skewFork, err = skew.Fork()
+		if err != nil {
+			slog.Warn("fork skew failed", "error", err)
+			continue
+		}
+		err = skewFork.Recover(_childPid)
+		if err != nil {
+			slog.Warn("recover child time failed", "pid", _childPid, "error", err)
+		}
+	}
+	slog.Info("recovering child time success")
+}
@@ -0,0 +1,228 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// The exit codes of watchmaker, 2 is left for the invalid flags
+const (
+	exitSuccess = 0
+	// exitFailure means no process is modified, or watchmaker fails before
+	// modifying any process
+	exitFailure = 1
+	// exitPartialFailure means some processes are modified, but some fail,
+	// e.g. a child exits while it is being modified
+	exitPartialFailure = 3
+)
+
+// The status of a symbol in the result document
+const (
+	symbolInjected = "injected"
+	symbolUpdated  = "updated"
+	symbolSkipped  = "skipped"
+	symbolFailed   = "failed"
+	// symbolNotInjected is printed by status only
+	symbolNotInjected = "not_injected"
+)
+
+// The status of a process in the result document
+const (
+	processModified = "modified"
+	processFailed   = "failed"
+)
+
+// injectResult is the document printed by --output json
+type injectResult struct {
+	// Status is success, partial_failure or failure, the same as the exit code
+	Status    string          `json:"status"`
+	Processes []processResult `json:"processes"`
+	// Error is set if watchmaker fails before modifying any process
+	Error string `json:"error,omitempty"`
+}
+
+type processResult struct {
+	Pid     uint64         `json:"pid"`
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Symbols []symbolResult `json:"symbols,omitempty"`
+	// Verified is set by --verify, the process is failed if it is false
+	Verified     *bool         `json:"verified,omitempty"`
+	Verification []clockResult `json:"verification,omitempty"`
+}
+
+// clockResult is a clock read inside the process by --verify, in nanoseconds
+type clockResult struct {
+	ClockID    int   `json:"clock_id"`
+	Observed   int64 `json:"observed_ns"`
+	Expected   int64 `json:"expected_ns"`
+	Difference int64 `json:"difference_ns"`
+}
+
+// symbolResult is the state of a symbol read back from the process after it
+// is modified, the delta and mask are omitted if the image doesn't have them
+type symbolResult struct {
+	Symbol           string  `json:"symbol"`
+	Status           string  `json:"status"`
+	Address          string  `json:"address,omitempty"`
+	DeltaSeconds     *int64  `json:"delta_seconds,omitempty"`
+	DeltaNanoseconds *int64  `json:"delta_nanoseconds,omitempty"`
+	ClockIdsMask     *uint64 `json:"clock_ids_mask,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// injectRecorder collects the result of every process modified by injectProcesses
+type injectRecorder struct {
+	processes map[uint64]processResult
+}
+
+func newInjectRecorder() *injectRecorder {
+	return &injectRecorder{processes: make(map[uint64]processResult)}
+}
+
+// imageStatus reads the images of skew injected to pid without stopping it, it
+// returns nil if the process can't be read
+func imageStatus(skew *watchmaker.Skew, pid uint64) *watchmaker.Status {
+	status, err := watchmaker.NewInjector(skew).Status(context.Background(), int(pid))
+	if err != nil {
+		return nil
+	}
+	return status
+}
+
+// record adds the result of injecting skew to pid, before is the status read
+// before injecting, which tells the injected symbols from the updated ones.
+// skew is nil if it fails before injecting.
+func (r *injectRecorder) record(skew *watchmaker.Skew, pid uint64, before *watchmaker.Status, err error) {
+	result := processResult{Pid: pid, Status: processModified}
+	if err != nil {
+		result.Status = processFailed
+		result.Error = err.Error()
+	}
+	defer func() {
+		r.processes[pid] = result
+	}()
+	if skew == nil {
+		return
+	}
+	after := imageStatus(skew, pid)
+	if after == nil {
+		return
+	}
+
+	var symbolErr *watchmaker.SymbolError
+	errors.As(err, &symbolErr)
+	for i, image := range after.Images {
+		symbol := newSymbolResult(image)
+		switch {
+		case symbolErr != nil && symbolErr.Symbol == image.Symbol:
+			symbol.Status = symbolFailed
+			symbol.Error = symbolErr.Err.Error()
+		case image.Injected && before != nil && i < len(before.Images) && before.Images[i].Injected:
+			symbol.Status = symbolUpdated
+		case image.Injected:
+			symbol.Status = symbolInjected
+		default:
+			symbol.Status = symbolSkipped
+		}
+		result.Symbols = append(result.Symbols, symbol)
+	}
+}
+
+// verify adds the clocks read inside pid to its result, the process is failed
+// if err is not nil
+func (r *injectRecorder) verify(pid uint64, verifications []watchmaker.Verification, err error) {
+	result := r.processes[pid]
+	verified := err == nil
+	result.Verified = &verified
+	for _, verification := range verifications {
+		result.Verification = append(result.Verification, clockResult{
+			ClockID:    verification.ClockID,
+			Observed:   verification.Observed,
+			Expected:   verification.Expected,
+			Difference: int64(verification.Difference()),
+		})
+	}
+	if err != nil {
+		result.Status = processFailed
+		result.Error = err.Error()
+	}
+	r.processes[pid] = result
+}
+
+// newSymbolResult fills the address, delta and mask of the injected image, the
+// status is left to the caller
+func newSymbolResult(image watchmaker.ImageStatus) symbolResult {
+	symbol := symbolResult{Symbol: image.Symbol}
+	if !image.Injected {
+		return symbol
+	}
+	symbol.Address = fmt.Sprintf("%#x", image.Address)
+	if sec, nsec, ok := image.Delta(); ok {
+		symbol.DeltaSeconds = &sec
+		symbol.DeltaNanoseconds = &nsec
+	}
+	if mask, ok := image.ClockIDsMask(); ok {
+		symbol.ClockIdsMask = &mask
+	}
+	return symbol
+}
+
+// exitCode returns exitSuccess if every process is modified
+func (r *injectRecorder) exitCode() int {
+	modified, failed := 0, 0
+	for _, result := range r.processes {
+		if result.Status == processModified {
+			modified++
+		} else {
+			failed++
+		}
+	}
+	switch {
+	case modified == 0:
+		return exitFailure
+	case failed > 0:
+		return exitPartialFailure
+	}
+	return exitSuccess
+}
+
+// print writes the result document to stdout
+func (r *injectRecorder) print() error {
+	result := injectResult{Processes: make([]processResult, 0, len(r.processes))}
+	switch r.exitCode() {
+	case exitSuccess:
+		result.Status = "success"
+	case exitPartialFailure:
+		result.Status = "partial_failure"
+	default:
+		result.Status = "failure"
+	}
+	for _, process := range r.processes {
+		result.Processes = append(result.Processes, process)
+	}
+	sort.Slice(result.Processes, func(i, j int) bool {
+		return result.Processes[i].Pid < result.Processes[j].Pid
+	})
+	return printResult(result)
+}
+
+// printFailure writes the document of an error before any process is modified
+// to stdout, its exit code is exitFailure
+func printFailure(msg string) error {
+	return printResult(injectResult{Status: "failure", Processes: []processResult{}, Error: msg})
+}
+
+func printResult(result injectResult) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
@@ -0,0 +1,380 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// runMain starts a command with the fake time, the command is stopped right
+// after exec and injected before it runs its first instruction. CLOCK_MONOTONIC
+// and CLOCK_BOOTTIME could be offset by a time namespace instead.
+func runMain(args []string) {
+	var (
+		runFakeTime     string
+		runFreeze       string
+		runClockId      string
+		runRate         float64
+		followExec      bool
+		monotonicOffset time.Duration
+		boottimeOffset  time.Duration
+		runImages       imageFlags
+	)
+	clockIdsSliceDefault := defaultClockIds()
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.StringVar(&runFakeTime, "faketime", "", "fake time (incremental/absolute value)")
+	fs.StringVar(&runFreeze, "freeze", "", "pin the time to a fixed instant (absolute value)")
+	fs.StringVar(&runClockId, "clockids", "", "clockids to modify, default is "+clockIdsSliceDefault)
+	fs.Float64Var(&runRate, "rate", 1, "speed of the fake time, e.g. 2 is twice as fast as the real time")
+	fs.BoolVar(&followExec, "follow-exec", false, "modify the programs executed later by the command and its descendants too")
+	fs.DurationVar(&monotonicOffset, "monotonic-offset", 0, "offset CLOCK_MONOTONIC by a time namespace, e.g. 240h")
+	fs.DurationVar(&boottimeOffset, "boottime-offset", 0, "offset CLOCK_BOOTTIME by a time namespace, e.g. 240h")
+	fs.Var(&runImages, "image", imageUsage)
+	var logging logFlags
+	logging.register(fs)
+	_ = fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fatal(err)
+	}
+
+	command := fs.Args()
+	if len(command) == 0 {
+		fatal("command can't is empty")
+	}
+	timens := monotonicOffset != 0 || boottimeOffset != 0
+	if runFakeTime == "" && runFreeze == "" && !timens {
+		fatal("faketime can't is empty")
+	}
+	if runFakeTime != "" && runFreeze != "" {
+		fatal("faketime and freeze can't be used together")
+	}
+	if runClockId == "" {
+		runClockId = clockIdsSliceDefault
+	}
+
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		fatal(err)
+	}
+	// vDSO is patched only if faketime or freeze is set, the time namespace alone
+	// doesn't need ptrace
+	var skew *watchmaker.Skew
+	if runFakeTime != "" || runFreeze != "" {
+		config, err := newConfig(runFakeTime, runFreeze, runClockId, runRate)
+		if err != nil {
+			fatal(err)
+		}
+		skew, err = watchmaker.GetSkew(config)
+		if err != nil {
+			fatal(err)
+		}
+		err = setImages(skew, runImages)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	slog.Info("running command", "command", command, "faketime", runFakeTime, "freeze", runFreeze, "clockids", runClockId,
+		"rate", runRate, "follow-exec", followExec, "monotonic-offset", monotonicOffset, "boottime-offset", boottimeOffset)
+
+	// the tracer is a thread rather than a process, all ptrace requests must be
+	// sent from the thread which started the command. The time namespace also
+	// belongs to the thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if timens {
+		err = unshareTimeNamespace(monotonicOffset, boottimeOffset)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	proc, err := os.StartProcess(path, command, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   &syscall.SysProcAttr{Ptrace: skew != nil},
+	})
+	if err != nil {
+		fatal(err)
+	}
+	childPid := proc.Pid
+	go forwardSignals(signals, childPid)
+
+	var status unix.WaitStatus
+	if skew != nil {
+		// the command stops with SIGTRAP after exec, the vDSO has been mapped then
+		_, err = unix.Wait4(childPid, &status, unix.WALL, nil)
+		if err != nil {
+			fatal(err)
+		}
+		if !status.Stopped() {
+			os.Exit(exitCode(status))
+		}
+
+		err = injectStopped(skew, childPid, followExec)
+		if err != nil {
+			_ = unix.Kill(childPid, unix.SIGKILL)
+			fatal(err)
+		}
+	}
+
+	// traced are the processes traced with --follow-exec, the command and the
+	// descendants attached by PTRACE_O_TRACEFORK. A process is not known until it
+	// reports its first stop.
+	traced := map[int]bool{childPid: true}
+	for {
+		wpid, err := unix.Wait4(-1, &status, unix.WALL, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if status.Exited() || status.Signaled() {
+			if wpid == childPid {
+				break
+			}
+			delete(traced, wpid)
+			continue
+		}
+		if !status.Stopped() {
+			continue
+		}
+
+		// only reached with --follow-exec, as the command is traced to catch exec
+		switch event := watchmaker.PtraceEvent(status); {
+		case !traced[wpid]:
+			// a new descendant starts with PTRACE_EVENT_STOP
+			traced[wpid] = true
+			err = unix.PtraceCont(wpid, 0)
+		case event == unix.PTRACE_EVENT_EXEC:
+			slog.Info("program executed, modifying time", "pid", wpid)
+			err = injectExec(skew, wpid)
+			if err != nil {
+				slog.Warn("modify time failed", "pid", wpid, "error", err)
+			}
+			err = nil
+		case event == unix.PTRACE_EVENT_FORK || event == unix.PTRACE_EVENT_VFORK || event == unix.PTRACE_EVENT_CLONE:
+			err = unix.PtraceCont(wpid, 0)
+		case event == unix.PTRACE_EVENT_STOP && status.StopSignal() == unix.SIGTRAP:
+			// stop by PTRACE_INTERRUPT
+			err = unix.PtraceCont(wpid, 0)
+		case event == unix.PTRACE_EVENT_STOP:
+			// group-stop, e.g. SIGTSTP, keep it stopped until SIGCONT
+			err = ptrace(unix.PTRACE_LISTEN, wpid, 0)
+		default:
+			// signal-delivery-stop, deliver the signal
+			err = unix.PtraceCont(wpid, int(status.StopSignal()))
+		}
+		if err != nil && err != unix.ESRCH {
+			slog.Warn("ptrace failed", "pid", wpid, "error", err)
+		}
+	}
+
+	signal.Stop(signals)
+	os.Exit(exitCode(status))
+}
+
+// loopInstr is a jump to itself, the command spins on it while it is injected
+var loopInstr = map[string][]byte{
+	// jmp .
+	"amd64": {0xeb, 0xfe},
+	// b .
+	"arm64": {0x00, 0x00, 0x00, 0x14},
+}
+
+// injectExec injects a process traced by --follow-exec which has executed a
+// new program. Every process has its own copy of the fake images, see Skew.Fork.
+func injectExec(skew *watchmaker.Skew, pid int) error {
+	s, err := skew.Fork()
+	if err != nil {
+		return giveUp(pid, true, err)
+	}
+	return injectStopped(s, pid, true)
+}
+
+// injectStopped injects the command which is stopped by ptrace. The injection
+// traces the command itself, so the command is detached while it spins on a jump
+// to itself at its current instruction, then it is stopped again and the origin
+// instruction is restored. With followExec it stays traced to catch the next
+// exec, and the processes it forks are traced too.
+// The command is never left stopped or spinning if it fails, it runs on with the
+// real time if its code is intact, or it is killed otherwise.
+func injectStopped(skew *watchmaker.Skew, pid int, followExec bool) error {
+	// PTRACE_GETREGS is not implemented on arm64, the library reads the
+	// registers in the way of the arch
+	pc, err := watchmaker.ReadIp(pid)
+	if err != nil {
+		return giveUp(pid, followExec, fmt.Errorf("%v get registers of process %d", err, pid))
+	}
+	ip := uintptr(pc)
+	origin := make([]byte, len(loopInstr[runtime.GOARCH]))
+	_, err = unix.PtracePeekText(pid, ip, origin)
+	if err != nil {
+		return giveUp(pid, followExec, fmt.Errorf("%v read instruction at %#x", err, ip))
+	}
+	_, err = unix.PtracePokeText(pid, ip, loopInstr[runtime.GOARCH])
+	if err != nil {
+		return giveUp(pid, followExec, fmt.Errorf("%v write instruction at %#x", err, ip))
+	}
+	err = unix.PtraceDetach(pid)
+	if err != nil {
+		_, errIn := unix.PtracePokeText(pid, ip, origin)
+		if errIn != nil {
+			return killSpinning(pid, fmt.Errorf("%v detach, %v restore instruction at %#x", err, errIn, ip))
+		}
+		return giveUp(pid, followExec, fmt.Errorf("%v detach", err))
+	}
+
+	slog.Info("modifying time", "pid", pid)
+	errInject := skew.Inject(uint64(pid))
+	if errInject == nil {
+		slog.Info("modifying time success")
+	}
+
+	var options uintptr
+	if followExec {
+		options = unix.PTRACE_O_TRACEEXEC | unix.PTRACE_O_TRACEFORK | unix.PTRACE_O_TRACEVFORK | unix.PTRACE_O_TRACECLONE
+	}
+	// the command spins on the jump until it is traced again, so it is killed if
+	// it can't be traced
+	err = ptrace(unix.PTRACE_SEIZE, pid, options)
+	if err != nil {
+		return killSpinning(pid, fmt.Errorf("%v seize", err))
+	}
+	err = unix.PtraceInterrupt(pid)
+	if err != nil {
+		return killSpinning(pid, fmt.Errorf("%v interrupt", err))
+	}
+	var status unix.WaitStatus
+	_, err = unix.Wait4(pid, &status, unix.WALL, nil)
+	if err != nil {
+		return killSpinning(pid, fmt.Errorf("%v wait", err))
+	}
+	if !status.Stopped() {
+		return fmt.Errorf("command exited while modifying time, pid: %d", pid)
+	}
+	// a signal may arrive before the interrupt, it is delivered when continued
+	var sig uintptr
+	if watchmaker.PtraceEvent(status) != unix.PTRACE_EVENT_STOP {
+		sig = uintptr(status.StopSignal())
+	}
+
+	_, err = unix.PtracePokeText(pid, ip, origin)
+	if err != nil {
+		return killSpinning(pid, fmt.Errorf("%v restore instruction at %#x", err, ip))
+	}
+	err = resume(pid, followExec, sig)
+	if err != nil {
+		return killSpinning(pid, fmt.Errorf("%v resume", err))
+	}
+	return errInject
+}
+
+// resume continues the command stopped by ptrace, it stays traced with
+// followExec, and is detached otherwise
+func resume(pid int, followExec bool, sig uintptr) error {
+	if followExec {
+		return ptrace(unix.PTRACE_CONT, pid, sig)
+	}
+	return ptrace(unix.PTRACE_DETACH, pid, sig)
+}
+
+// giveUp resumes the command stopped by ptrace with the real time, as its time
+// can't be modified because of err. The command is killed if it can't be resumed.
+func giveUp(pid int, followExec bool, err error) error {
+	errIn := resume(pid, followExec, 0)
+	if errIn != nil {
+		return killSpinning(pid, fmt.Errorf("%v, %v resume", err, errIn))
+	}
+	slog.Warn("command resumed with the real time", "pid", pid, "error", err)
+	return err
+}
+
+// killSpinning kills the command which can't be resumed, e.g. it spins on the
+// jump written by injectStopped and its instruction can't be restored
+func killSpinning(pid int, err error) error {
+	slog.Warn("command can't be resumed, killing it", "pid", pid, "error", err)
+	_ = unix.Kill(pid, unix.SIGKILL)
+	return err
+}
+
+// forwardedSignals are caught by watchmaker and sent to the command, the other
+// signals take the default action on watchmaker, e.g. SIGCHLD of the command
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2,
+	syscall.SIGALRM, syscall.SIGWINCH, syscall.SIGTSTP, syscall.SIGCONT, syscall.SIGTTIN, syscall.SIGTTOU,
+}
+
+// terminalSignals are sent by the terminal to its foreground process group
+var terminalSignals = map[syscall.Signal]bool{
+	syscall.SIGINT:   true,
+	syscall.SIGQUIT:  true,
+	syscall.SIGTSTP:  true,
+	syscall.SIGWINCH: true,
+}
+
+// forwardSignals sends the signals received by watchmaker to the command. The
+// command shares the process group of watchmaker, so the signals of the terminal
+// reach it already if the group is in the foreground, e.g. Ctrl-C, and they are
+// not sent twice. A program counting interrupts would see two otherwise.
+func forwardSignals(signals <-chan os.Signal, pid int) {
+	for sig := range signals {
+		s, ok := sig.(syscall.Signal)
+		if !ok {
+			continue
+		}
+		if terminalSignals[s] && inForeground() {
+			continue
+		}
+		_ = unix.Kill(pid, s)
+	}
+}
+
+// inForeground returns true if the process group of watchmaker is the
+// foreground process group of its controlling terminal
+func inForeground() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	defer tty.Close()
+	pgrp, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	if err != nil {
+		return false
+	}
+	return pgrp == unix.Getpgrp()
+}
+
+// exitCode returns the exit code of the command, 128+n if it is killed by signal n
+// like shells do
+func exitCode(status unix.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// ptrace sends a ptrace request which is not wrapped by unix with data
+func ptrace(request int, pid int, data uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(pid), 0, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
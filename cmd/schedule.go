@@ -0,0 +1,216 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// timeline is the content of the --timeline file, e.g.
+//
+//	steps:
+//	  - at: 0s
+//	    faketime: "+0"
+//	  - at: 30s
+//	    faketime: "2025-12-31 23:59:50"
+//	  - at: 5m
+//	    faketime: "0"
+type timeline struct {
+	Steps []timelineStep `yaml:"steps"`
+}
+
+// timelineStep is applied when the time passed since watchmaker started reaches At
+type timelineStep struct {
+	// At is a duration like 30s or 5m, or seconds without unit
+	At string `yaml:"at"`
+	// FakeTime is the same as --faketime
+	FakeTime string `yaml:"faketime"`
+	// Freeze is the same as --freeze
+	Freeze string `yaml:"freeze"`
+	// Rate is the same as --rate, 0 means real speed
+	Rate float64 `yaml:"rate"`
+
+	at time.Duration
+}
+
+// loadTimeline reads the timeline file and sorts its steps by time
+func loadTimeline(path string) (*timeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t timeline
+	err = yaml.Unmarshal(data, &t)
+	if err != nil {
+		return nil, fmt.Errorf("%v parse timeline %s", err, path)
+	}
+	if len(t.Steps) == 0 {
+		return nil, fmt.Errorf("timeline %s has no steps", path)
+	}
+
+	for i := range t.Steps {
+		step := &t.Steps[i]
+		if seconds, err := strconv.Atoi(step.At); err == nil {
+			step.at = time.Duration(seconds) * time.Second
+		} else {
+			step.at, err = time.ParseDuration(step.At)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: unable to parse at %q: %v", i, step.At, err)
+			}
+		}
+		if step.at < 0 {
+			return nil, fmt.Errorf("step %d: at can't be negative", i)
+		}
+		if step.FakeTime == "" && step.Freeze == "" {
+			return nil, fmt.Errorf("step %d: faketime can't is empty", i)
+		}
+		if step.FakeTime != "" && step.Freeze != "" {
+			return nil, fmt.Errorf("step %d: faketime and freeze can't be used together", i)
+		}
+		if step.Rate == 0 {
+			step.Rate = 1
+		}
+	}
+
+	sort.SliceStable(t.Steps, func(i, j int) bool {
+		return t.Steps[i].at < t.Steps[j].at
+	})
+	return &t, nil
+}
+
+// scheduleMain applies the steps of a timeline to a process one by one, and
+// recovers the process when watchmaker exits
+func scheduleMain(args []string) {
+	var (
+		schedulePid     uint64
+		timelinePath    string
+		scheduleClockId string
+	)
+	clockIdsSliceDefault := defaultClockIds()
+	fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+	fs.Uint64Var(&schedulePid, "pid", 0, "pid of target program")
+	fs.StringVar(&timelinePath, "timeline", "", "yaml file with the steps to apply")
+	fs.StringVar(&scheduleClockId, "clockids", "", "clockids to modify, default is "+clockIdsSliceDefault)
+	var logging logFlags
+	logging.register(fs)
+	_ = fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fatal(err)
+	}
+
+	if schedulePid <= 0 {
+		fatal("pid can't is zero")
+	}
+	if timelinePath == "" {
+		fatal("timeline can't is empty")
+	}
+	if scheduleClockId == "" {
+		scheduleClockId = clockIdsSliceDefault
+	}
+
+	t, err := loadTimeline(timelinePath)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("scheduling time", "pid", schedulePid, "timeline", timelinePath, "steps", len(t.Steps), "clockids", scheduleClockId)
+
+	skew, err := watchmaker.GetSkew(watchmaker.NewConfig(0, 0, 0))
+	if err != nil {
+		fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	exited := watchExit(schedulePid)
+
+	// injected is whether the process is fully injected, so the later steps
+	// update it; lastStep is the last step applied, -1 if none
+	injected := false
+	lastStep := -1
+	start := time.Now()
+	for i, step := range t.Steps {
+		timer := time.NewTimer(time.Until(start.Add(step.at)))
+		select {
+		case sig := <-signals:
+			timer.Stop()
+			slog.Info("received signal", "signal", sig, "before-step", i)
+			recoverSchedule(skew, schedulePid, lastStep)
+			return
+		case <-exited:
+			timer.Stop()
+			slog.Info("process exited", "pid", schedulePid)
+			return
+		case <-timer.C:
+		}
+
+		config, err := newConfig(step.FakeTime, step.Freeze, scheduleClockId, step.Rate)
+		if err != nil {
+			slog.Warn("skip step", "step", i, "error", err)
+			continue
+		}
+		slog.Info("applying step", "step", i, "at", step.At, "faketime", step.FakeTime, "freeze", step.Freeze, "rate", step.Rate)
+		if !injected {
+			skew.SkewConfig = config
+			err = skew.Inject(schedulePid)
+		} else {
+			err = skew.Update(schedulePid, config)
+		}
+		if err != nil {
+			slog.Warn("apply step failed", "step", i, "error", err)
+			continue
+		}
+		injected = true
+		lastStep = i
+	}
+
+	slog.Info("all steps applied, waiting for signal")
+	select {
+	case sig := <-signals:
+		slog.Info("received signal", "signal", sig)
+		recoverSchedule(skew, schedulePid, lastStep)
+	case <-exited:
+		slog.Info("process exited", "pid", schedulePid)
+	}
+}
+
+// recoverSchedule recovers the process, even if no step has been applied, as a
+// failed Inject may leave some of the images injected. Recover does nothing to
+// the images not injected.
+func recoverSchedule(skew *watchmaker.Skew, pid uint64, lastStep int) {
+	slog.Info("recovering time", "pid", pid, "last-step", lastStep)
+	err := skew.Recover(pid)
+	if err != nil {
+		slog.Error("recovering time failed, the process may be still modified", "pid", pid, "last-step", lastStep, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("recovering time success")
+}
+
+// watchExit returns a channel closed when the process exits
+func watchExit(pid uint64) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !watchmaker.ProcessExists(int(pid)) {
+				close(exited)
+				return
+			}
+		}
+	}()
+	return exited
+}
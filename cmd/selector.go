@@ -0,0 +1,139 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// processSelector selects processes by --name, --cmdline-regex, --exe, --cgroup
+// and --unit, a process is selected only if it matches all the given conditions.
+type processSelector struct {
+	// name is compared with comm in /proc/pid/stat
+	name string
+	// cmdline is matched against /proc/pid/cmdline with arguments joined by space
+	cmdline *regexp.Regexp
+	// exe is compared with the link /proc/pid/exe
+	exe string
+	// cgroupPids is the processes in the cgroup given by --cgroup or --unit,
+	// nil means all processes
+	cgroupPids map[uint64]bool
+	// excludeSelf excludes watchmaker itself and its ancestors, e.g. the shell or sudo
+	// which started watchmaker and has the same pattern in its command line
+	excludeSelf bool
+}
+
+func newProcessSelector(name string, cmdlineRegex string, exe string, cgroup string, unit string, excludeSelf bool) (*processSelector, error) {
+	s := &processSelector{
+		name:        name,
+		excludeSelf: excludeSelf,
+	}
+	if cmdlineRegex != "" {
+		re, err := regexp.Compile(cmdlineRegex)
+		if err != nil {
+			return nil, fmt.Errorf("%v compile cmdline regex", err)
+		}
+		s.cmdline = re
+	}
+	if exe != "" {
+		path, err := filepath.Abs(exe)
+		if err != nil {
+			return nil, err
+		}
+		// the link in /proc/pid/exe is resolved
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		s.exe = path
+	}
+	if cgroup != "" && unit != "" {
+		return nil, fmt.Errorf("cgroup and unit can't be used together")
+	}
+	if cgroup != "" || unit != "" {
+		var dir string
+		var err error
+		if cgroup != "" {
+			dir, err = resolveCgroup(cgroup)
+		} else {
+			dir, err = unitCgroup(unit)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.cgroupPids, err = cgroupProcesses(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// empty returns true if no condition is given
+func (s *processSelector) empty() bool {
+	return s.name == "" && s.cmdline == nil && s.exe == "" && s.cgroupPids == nil
+}
+
+// match returns true if the process matches all the conditions
+func (s *processSelector) match(info procInfo) bool {
+	dir := filepath.Join(DefaultProcPrefix, strconv.FormatUint(info.pid, 10))
+	if s.cgroupPids != nil && !s.cgroupPids[info.pid] {
+		return false
+	}
+	if s.name != "" && info.comm != s.name {
+		return false
+	}
+	if s.cmdline != nil {
+		cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			return false
+		}
+		cmdline = bytes.TrimRight(cmdline, "\x00")
+		if !s.cmdline.Match(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})) {
+			return false
+		}
+	}
+	if s.exe != "" {
+		exe, err := os.Readlink(filepath.Join(dir, "exe"))
+		if err != nil || exe != s.exe {
+			return false
+		}
+	}
+	return true
+}
+
+// selectProcesses returns the pids of all matched processes in order
+func (s *processSelector) selectProcesses() ([]uint64, error) {
+	infos, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[uint64]bool)
+	if s.excludeSelf {
+		parents := make(map[uint64]uint64, len(infos))
+		for _, info := range infos {
+			parents[info.pid] = info.ppid
+		}
+		for self := uint64(os.Getpid()); self > 0 && !excluded[self]; self = parents[self] {
+			excluded[self] = true
+		}
+	}
+
+	var pids []uint64
+	for _, info := range infos {
+		if excluded[info.pid] || !s.match(info) {
+			continue
+		}
+		pids = append(pids, info.pid)
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		return pids[i] < pids[j]
+	})
+	return pids, nil
+}
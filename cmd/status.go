@@ -0,0 +1,106 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// statusResult is the document printed by status --output json
+type statusResult struct {
+	Pid      uint64         `json:"pid"`
+	Injected bool           `json:"injected"`
+	Symbols  []symbolResult `json:"symbols"`
+}
+
+// statusMain prints whether the vDSO symbols of a process jump to fake images
+// and the variables of the images. The memory of the process is only read by
+// process_vm_readv, so it is never stopped.
+func statusMain(args []string) {
+	var (
+		statusPid    uint64
+		statusOutput string
+		statusImages imageFlags
+	)
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Uint64Var(&statusPid, "pid", 0, "pid of target program")
+	fs.StringVar(&statusOutput, "output", "text", "text prints a table, json prints a document")
+	fs.Var(&statusImages, "image", imageUsage)
+	var logging logFlags
+	logging.register(fs)
+	_ = fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fatal(err)
+	}
+
+	if statusPid <= 0 {
+		fatal("pid can't is zero")
+	}
+	if statusOutput != "text" && statusOutput != "json" {
+		fatal(fmt.Sprintf("invalid output %s, expected text or json", statusOutput))
+	}
+
+	skew, err := watchmaker.GetSkew(watchmaker.NewConfig(0, 0, 0))
+	if err != nil {
+		fatal(err)
+	}
+	err = setImages(skew, statusImages)
+	if err != nil {
+		fatal(err)
+	}
+	status, err := watchmaker.NewInjector(skew).Status(context.Background(), int(statusPid))
+	if err != nil {
+		fatal(err)
+	}
+
+	result := statusResult{Pid: statusPid, Injected: status.Injected()}
+	for _, image := range status.Images {
+		symbol := newSymbolResult(image)
+		symbol.Status = symbolNotInjected
+		if image.Injected {
+			symbol.Status = symbolInjected
+		}
+		result.Symbols = append(result.Symbols, symbol)
+	}
+
+	if statusOutput == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(result)
+	} else {
+		err = printStatus(result)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// printStatus writes result as a table, the variables missing in an image are
+// printed as -
+func printStatus(result statusResult) error {
+	fmt.Printf("pid: %d, injected: %v\n", result.Pid, result.Injected)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SYMBOL\tSTATUS\tADDRESS\tTV_SEC_DELTA\tTV_NSEC_DELTA\tCLOCK_IDS_MASK")
+	for _, symbol := range result.Symbols {
+		address, sec, nsec, mask := "-", "-", "-", "-"
+		if symbol.Address != "" {
+			address = symbol.Address
+		}
+		if symbol.DeltaSeconds != nil {
+			sec = fmt.Sprint(*symbol.DeltaSeconds)
+			nsec = fmt.Sprint(*symbol.DeltaNanoseconds)
+		}
+		if symbol.ClockIdsMask != nil {
+			mask = fmt.Sprintf("%#x", *symbol.ClockIdsMask)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", symbol.Symbol, symbol.Status, address, sec, nsec, mask)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,52 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// timens_offsets is only in /proc/pid rather than /proc/pid/task/tid, so the
+	// namespace of the main thread is the only one could be written. The main
+	// goroutine is kept on the main thread to unshare the namespace there.
+	runtime.LockOSThread()
+}
+
+// unshareTimeNamespace creates a time namespace, which is entered by the children
+// created later by the current thread, and offsets CLOCK_MONOTONIC and
+// CLOCK_BOOTTIME in it. The offsets can't be changed once a process has entered
+// the namespace. It must be called by the main goroutine, as the namespace for
+// children belongs to the thread rather than the process. Linux 5.6+ is required.
+func unshareTimeNamespace(monotonic time.Duration, boottime time.Duration) error {
+	err := unix.Unshare(unix.CLONE_NEWTIME)
+	if err != nil {
+		return fmt.Errorf("%v unshare time namespace, linux 5.6+ with CONFIG_TIME_NS is required", err)
+	}
+
+	offsets := fmt.Sprintf("%d %s\n%d %s\n",
+		unix.CLOCK_MONOTONIC, timensOffset(monotonic),
+		unix.CLOCK_BOOTTIME, timensOffset(boottime))
+	err = os.WriteFile("/proc/self/timens_offsets", []byte(offsets), 0)
+	if err != nil {
+		return fmt.Errorf("%v write offsets of time namespace", err)
+	}
+	return nil
+}
+
+// timensOffset formats d as "<secs> <nanosecs>", nanosecs must be in [0, 999999999]
+// even if d is negative
+func timensOffset(d time.Duration) string {
+	secs := int64(d / time.Second)
+	nsecs := int64(d % time.Second)
+	if nsecs < 0 {
+		secs--
+		nsecs += int64(time.Second)
+	}
+	return fmt.Sprintf("%d %d", secs, nsecs)
+}
@@ -0,0 +1,98 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+
+	"github.com/busybox-org/watchmaker"
+)
+
+// updateMain changes the fake time of a process injected before, without
+// patching the vDSO again
+func updateMain(args []string) {
+	var (
+		updatePid     uint64
+		updateTime    string
+		updateClockId string
+		updateRate    float64
+		updateFreeze  string
+		recursive     bool
+		updateImages  imageFlags
+	)
+	clockIdsSliceDefault := defaultClockIds()
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	fs.Uint64Var(&updatePid, "pid", 0, "pid of target program")
+	fs.StringVar(&updateTime, "faketime", "", "fake time (incremental/absolute value)")
+	fs.StringVar(&updateClockId, "clockids", "", "clockids to modify, default is "+clockIdsSliceDefault)
+	fs.Float64Var(&updateRate, "rate", 1, "speed of the fake time, e.g. 2 is twice as fast as the real time")
+	fs.StringVar(&updateFreeze, "freeze", "", "pin the time to a fixed instant (absolute value)")
+	fs.BoolVar(&recursive, "recursive", false, "update child processes too")
+	fs.Var(&updateImages, "image", imageUsage)
+	var logging logFlags
+	logging.register(fs)
+	_ = fs.Parse(args)
+	if err := logging.setup(); err != nil {
+		fatal(err)
+	}
+
+	if updatePid <= 0 {
+		fatal("pid can't is zero")
+	}
+	if updateTime == "" && updateFreeze == "" {
+		fatal("faketime can't is empty")
+	}
+	if updateTime != "" && updateFreeze != "" {
+		fatal("faketime and freeze can't be used together")
+	}
+	if updateClockId == "" {
+		updateClockId = clockIdsSliceDefault
+	}
+	slog.Info("updating time", "pid", updatePid, "faketime", updateTime, "freeze", updateFreeze, "clockids", updateClockId, "rate", updateRate)
+
+	config, err := newConfig(updateTime, updateFreeze, updateClockId, updateRate)
+	if err != nil {
+		fatal(err)
+	}
+
+	skew, err := watchmaker.GetSkew(config)
+	if err != nil {
+		fatal(err)
+	}
+	err = setImages(skew, updateImages)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("updating time", "pid", updatePid)
+	err = skew.Update(updatePid, config)
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("updating time success")
+
+	if !recursive {
+		return
+	}
+	childPIDs, err := getChildProcesses(updatePid)
+	if err != nil {
+		fatal(err)
+	}
+	if len(childPIDs) == 0 {
+		return
+	}
+	slog.Info("updating child time", "pids", childPIDs)
+	for _, _childPid := range childPIDs {
+		var skewFork *watchmaker.Skew
+		skewFork, err = skew.Fork()
+		if err != nil {
+			slog.Warn("fork skew failed", "error", err)
+			continue
+		}
+		err = skewFork.Update(_childPid, config)
+		if err != nil {
+			slog.Warn("update child time failed", "pid", _childPid, "error", err)
+		}
+	}
+	slog.Info("updating child time success")
+}
@@ -5,13 +5,17 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/busybox-org/watchmaker"
 )
@@ -20,109 +24,380 @@ var (
 	pid           uint64
 	fakeTime      string
 	clockIdsSlice string
+	rate          float64
+	freeze        string
+	duration      time.Duration
+	name          string
+	cmdlineRegex  string
+	exe           string
+	cgroup        string
+	unit          string
+	excludeSelf   bool
+	follow        bool
+	followPeriod  time.Duration
+	backend       string
+	stopMode      string
+	images        imageFlags
+	logging       logFlags
+	output        string
+	verify        bool
+	tolerance     time.Duration
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetOutput(os.Stdout)
-}
-
 func main() {
-	var clockIdsSliceDefault string
-	if runtime.GOARCH == "arm64" {
-		// on modern arm64 there is no __NR_time syscall;
-		// glibc is using clock_gettime() wrapper [1] with CLOCK_REALTIME_COARSE clockid [2]
-		//
-		// [1] https://sourceware.org/git/?p=glibc.git;a=blob;f=time/time.c;h=d5dcb2e7ed83bc491ed026caf914caf4f1ae9202;hb=c804cd1c00adde061ca51711f63068c103e94eef
-		// [2] https://sourceware.org/git/?p=glibc.git;a=blob;f=sysdeps/unix/sysv/linux/time-clockid.h;h=91543b69e47ce2828316ff0b3361ec435159690e;hb=c804cd1c00adde061ca51711f63068c103e94eef
-		clockIdsSliceDefault = "CLOCK_REALTIME,CLOCK_REALTIME_COARSE"
-	} else {
-		clockIdsSliceDefault = "CLOCK_REALTIME"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "recover":
+			recoverMain(os.Args[2:])
+			return
+		case "update":
+			updateMain(os.Args[2:])
+			return
+		case "schedule":
+			scheduleMain(os.Args[2:])
+			return
+		case "run":
+			runMain(os.Args[2:])
+			return
+		case "status":
+			statusMain(os.Args[2:])
+			return
+		}
 	}
 
+	clockIdsSliceDefault := defaultClockIds()
 	flag.Uint64Var(&pid, "pid", 0, "pid of target program")
 	flag.StringVar(&fakeTime, "faketime", "", "fake time (incremental/absolute value)")
 	flag.StringVar(&clockIdsSlice, "clockids", "", "clockids to modify, default is "+clockIdsSliceDefault)
+	flag.Float64Var(&rate, "rate", 1, "speed of the fake time, e.g. 2 is twice as fast as the real time")
+	flag.StringVar(&freeze, "freeze", "", "pin the time to a fixed instant (absolute value)")
+	flag.DurationVar(&duration, "duration", 0, "stay in foreground and recover after duration, e.g. 10m")
+	flag.StringVar(&name, "name", "", "select target programs by process name (comm)")
+	flag.StringVar(&cmdlineRegex, "cmdline-regex", "", "select target programs by regex on command line")
+	flag.StringVar(&exe, "exe", "", "select target programs by executable path")
+	flag.StringVar(&cgroup, "cgroup", "", "select target programs in cgroup (v2) and its sub-cgroups")
+	flag.StringVar(&unit, "unit", "", "select target programs in the cgroup of systemd unit")
+	flag.BoolVar(&excludeSelf, "exclude-self", true, "never select watchmaker itself and its ancestors")
+	flag.BoolVar(&follow, "follow", false, "stay in foreground, modify new children and programs executed later, recover on SIGINT/SIGTERM")
+	flag.DurationVar(&followPeriod, "follow-interval", time.Second, "interval of scanning new children in follow mode")
+	flag.StringVar(&backend, "backend", string(watchmaker.BackendVDSO), "vdso replaces the vDSO functions, syscall traces the time syscalls too and stays in foreground until SIGINT/SIGTERM")
+	flag.StringVar(&stopMode, "stop-mode", string(watchmaker.StopModeAll), stopModeUsage)
+	flag.Var(&images, "image", imageUsage)
+	flag.StringVar(&output, "output", "text", "text prints only the logs, json prints a result document of the modified processes to stdout")
+	flag.BoolVar(&verify, "verify", false, "read the time inside every modified process by calling its clock_gettime, and fail the process if it is not the fake time")
+	flag.DurationVar(&tolerance, "verify-tolerance", 100*time.Millisecond, "max difference between the time read by --verify and the fake time")
+	logging.register(flag.CommandLine)
 	flag.Parse()
+	if output != "text" && output != "json" {
+		fatal(fmt.Sprintf("invalid output %s, expected text or json", output))
+	}
+	if err := logging.setup(); err != nil {
+		fatalResult(err)
+	}
 
-	if pid <= 0 {
-		log.Fatalln("pid can't is zero")
+	selector, err := newProcessSelector(name, cmdlineRegex, exe, cgroup, unit, excludeSelf)
+	if err != nil {
+		fatalResult(err)
+	}
+	if pid <= 0 && selector.empty() {
+		fatalResult("pid can't is zero")
 	}
-	if fakeTime == "" {
-		log.Fatalln("faketime can't is empty")
+	if fakeTime == "" && freeze == "" {
+		fatalResult("faketime can't is empty")
 	}
+	if fakeTime != "" && freeze != "" {
+		fatalResult("faketime and freeze can't be used together")
+	}
+	if follow && followPeriod <= 0 {
+		fatalResult("follow-interval must be positive")
+	}
+	skewBackend, err := watchmaker.ParseBackend(backend)
+	if err != nil {
+		fatalResult(err)
+	}
+	skewStopMode, err := watchmaker.ParseStopMode(stopMode)
+	if err != nil {
+		fatalResult(err)
+	}
+	if verify && skewBackend == watchmaker.BackendSyscall {
+		fatalResult("verify can't be used with syscall backend")
+	}
+	// the process is modified by syscall backend only while watchmaker is running
+	stay := duration > 0 || follow || skewBackend == watchmaker.BackendSyscall
 	if clockIdsSlice == "" {
 		clockIdsSlice = clockIdsSliceDefault
 	}
-	log.Println("pid:", pid, "faketime:", fakeTime, "clockids:", clockIdsSlice)
+	slog.Info("modifying time", "pid", pid, "name", name, "cmdline-regex", cmdlineRegex, "exe", exe, "cgroup", cgroup, "unit", unit,
+		"faketime", fakeTime, "freeze", freeze, "clockids", clockIdsSlice, "rate", rate, "follow", follow, "backend", backend, "stop-mode", stopMode)
 
-	offsetTime, err := watchmaker.CalculateOffset(fakeTime)
-	if err != nil {
-		log.Fatalln(err)
+	var targets []uint64
+	if pid > 0 {
+		targets = append(targets, pid)
+	}
+	if !selector.empty() {
+		matched, err := selector.selectProcesses()
+		if err != nil {
+			fatalResult(err)
+		}
+		slog.Info("selected processes", "pids", matched)
+		targets = append(targets, matched...)
+	}
+	if len(targets) == 0 {
+		fatalResult("no process selected")
 	}
 
-	clkIds, err := watchmaker.EncodeClkIds(strings.Split(clockIdsSlice, ","))
+	config, err := newConfig(fakeTime, freeze, clockIdsSlice, rate)
 	if err != nil {
-		log.Fatalln(err)
+		fatalResult(err)
 	}
 
-	skew, err := watchmaker.GetSkew(watchmaker.NewConfig(0, offsetTime.Nanoseconds(), clkIds))
+	// signals are caught before injecting, so the injected processes are
+	// recovered even if watchmaker is interrupted while injecting
+	var signals chan os.Signal
+	if stay {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	}
+
+	skew, err := watchmaker.GetSkewWithBackend(config, skewBackend)
 	if err != nil {
-		log.Fatalln(err)
+		fatalResult(err)
 	}
-	log.Printf("modifying time, pid: %v", pid)
-	err = skew.Inject(pid)
+	skew.SetStopMode(skewStopMode)
+	err = setImages(skew, images)
 	if err != nil {
-		log.Fatalln(err)
+		fatalResult(err)
+	}
+	recorder := newInjectRecorder()
+	injected, failed := injectProcesses(skew, targets, recorder)
+	if verify {
+		verifyProcesses(injected, tolerance, recorder)
+	}
+	if output == "json" {
+		err = recorder.print()
+		if err != nil {
+			slog.Error("print result failed", "error", err)
+		}
+	} else {
+		// logs below warn are hidden by default, so the summary is printed
+		fmt.Fprintf(os.Stderr, "modifying time done, modified: %v, failed: %v\n", sortedPids(injected), sortedPids(failed))
+	}
+	if len(injected) == 0 {
+		if stay {
+			recoverProcesses(skew, injected, failed)
+		}
+		fatal("no process modified")
 	}
-	log.Println("modifying time success")
 
-	childPIDs, err := getChildProcesses(pid)
-	if err != nil {
-		log.Fatalln(err)
+	if follow {
+		followProcesses(skew, injected, failed, followPeriod, duration, signals)
+	} else if stay {
+		recoverAfter(duration, signals, skew, injected, failed)
 	}
-	if len(childPIDs) == 0 {
-		return
+	os.Exit(recorder.exitCode())
+}
+
+// fatalResult is fatal for the errors before any process is modified, which
+// prints a failure document first with --output json
+func fatalResult(v ...any) {
+	if output == "json" {
+		err := printFailure(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+		if err != nil {
+			slog.Error("print result failed", "error", err)
+		}
+	}
+	fatal(v...)
+}
+
+// injectProcesses injects every target and all its children, a process is
+// injected only once even if it is selected more than once. The result of
+// every process is recorded to recorder.
+func injectProcesses(skew *watchmaker.Skew, targets []uint64, recorder *injectRecorder) (map[uint64]*watchmaker.Skew, map[uint64]error) {
+	injected := make(map[uint64]*watchmaker.Skew)
+	failed := make(map[uint64]error)
+
+	// skew is used by the first process, the others use forks of it
+	used := false
+	inject := func(_pid uint64) error {
+		if _, ok := injected[_pid]; ok {
+			return nil
+		}
+		if _, ok := failed[_pid]; ok {
+			return failed[_pid]
+		}
+		s := skew
+		if used {
+			var err error
+			s, err = skew.Fork()
+			if err != nil {
+				failed[_pid] = err
+				recorder.record(nil, _pid, nil, err)
+				return err
+			}
+		}
+		used = true
+		before := imageStatus(s, _pid)
+		err := s.Inject(_pid)
+		recorder.record(s, _pid, before, err)
+		if err != nil {
+			failed[_pid] = err
+			return err
+		}
+		injected[_pid] = s
+		return nil
+	}
+
+	for _, target := range targets {
+		slog.Info("modifying time", "pid", target)
+		err := inject(target)
+		if err != nil {
+			slog.Warn("modify time failed", "pid", target, "error", err)
+			continue
+		}
+		slog.Info("modifying time success")
+
+		childPIDs, err := getChildProcesses(target)
+		if err != nil {
+			slog.Warn("get child processes failed", "pid", target, "error", err)
+			continue
+		}
+		if len(childPIDs) == 0 {
+			continue
+		}
+		slog.Info("modifying child time", "pids", childPIDs)
+		for _, _childPid := range childPIDs {
+			err = inject(_childPid)
+			if err != nil {
+				slog.Warn("modify child time failed", "pid", _childPid, "error", err)
+			}
+		}
+		slog.Info("modifying child time success")
 	}
-	log.Printf("modifying child time, pids: %v", childPIDs)
-	for _, _childPid := range childPIDs {
-		var skewFork *watchmaker.Skew
-		skewFork, err = skew.Fork()
+	return injected, failed
+}
+
+// verifyProcesses reads the time inside every injected process and compares it
+// with the fake time, the result of every process is recorded to recorder
+func verifyProcesses(injected map[uint64]*watchmaker.Skew, tolerance time.Duration, recorder *injectRecorder) {
+	for _, _pid := range sortedPids(injected) {
+		verifications, err := injected[_pid].Verify(_pid, tolerance)
+		recorder.verify(_pid, verifications, err)
 		if err != nil {
-			log.Println(err)
+			slog.Warn("verify time failed", "pid", _pid, "error", err)
 			continue
 		}
-		err = skewFork.Inject(_childPid)
+		for _, verification := range verifications {
+			slog.Info("verify time success", "pid", _pid, "clockid", verification.ClockID,
+				"observed", time.Unix(0, verification.Observed), "difference", verification.Difference())
+		}
+	}
+}
+
+// sortedPids returns the keys of m in order
+func sortedPids[V any](m map[uint64]V) []uint64 {
+	pids := make([]uint64, 0, len(m))
+	for _pid := range m {
+		pids = append(pids, _pid)
+	}
+	sort.Slice(pids, func(i, j int) bool {
+		return pids[i] < pids[j]
+	})
+	return pids
+}
+
+// defaultClockIds returns the clockids modified when --clockids is not set
+func defaultClockIds() string {
+	if runtime.GOARCH == "arm64" {
+		// on modern arm64 there is no __NR_time syscall;
+		// glibc is using clock_gettime() wrapper [1] with CLOCK_REALTIME_COARSE clockid [2]
+		//
+		// [1] https://sourceware.org/git/?p=glibc.git;a=blob;f=time/time.c;h=d5dcb2e7ed83bc491ed026caf914caf4f1ae9202;hb=c804cd1c00adde061ca51711f63068c103e94eef
+		// [2] https://sourceware.org/git/?p=glibc.git;a=blob;f=sysdeps/unix/sysv/linux/time-clockid.h;h=91543b69e47ce2828316ff0b3361ec435159690e;hb=c804cd1c00adde061ca51711f63068c103e94eef
+		return "CLOCK_REALTIME,CLOCK_REALTIME_COARSE"
+	}
+	return "CLOCK_REALTIME"
+}
+
+// newConfig builds the skew config from --faketime or --freeze, --clockids and --rate
+func newConfig(fakeTime string, freeze string, clockIds string, rate float64) (*watchmaker.Config, error) {
+	clkIds, err := watchmaker.EncodeClkIds(strings.Split(clockIds, ","))
+	if err != nil {
+		return nil, err
+	}
+
+	if freeze != "" {
+		instant, err := watchmaker.ParseDateAny(freeze)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse freeze time: %v", err)
+		}
+		return watchmaker.NewFreezeConfig(instant, clkIds), nil
+	}
+
+	offsetTime, err := watchmaker.CalculateOffset(fakeTime)
+	if err != nil {
+		return nil, err
+	}
+
+	config := watchmaker.NewConfig(0, offsetTime.Nanoseconds(), clkIds)
+	if rate != 1 {
+		err = config.SetRate(rate, time.Now())
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
 	}
-	log.Println("modifying child time success")
+	return config, nil
 }
 
 const DefaultProcPrefix = "/proc"
 
-// GetChildProcesses will return all child processes's pid. Include all generations.
-// only return error when /proc/pid/tasks cannot be read
-func getChildProcesses(ppid uint64) ([]uint64, error) {
+// procInfo is the summary of /proc/pid/stat
+type procInfo struct {
+	pid  uint64
+	ppid uint64
+	comm string
+}
+
+// listProcesses returns the stat of all processes in /proc
+func listProcesses() ([]procInfo, error) {
 	procs, err := os.ReadDir(DefaultProcPrefix)
 	if err != nil {
-		return nil, fmt.Errorf("%T read /proc/pid/tasks , ppid : %d", err, ppid)
+		return nil, fmt.Errorf("%v read %s", err, DefaultProcPrefix)
 	}
 
-	pidMap := make(map[uint64][]uint64) // Map of parent PID to child PIDs
-	var mu sync.Mutex                   // Mutex for synchronizing map writes
-	var wg sync.WaitGroup               // WaitGroup to manage goroutines
+	var infos []procInfo
+	var mu sync.Mutex     // Mutex for synchronizing slice writes
+	var wg sync.WaitGroup // WaitGroup to manage goroutines
 
 	for _, proc := range procs {
 		wg.Add(1)
 		go func(name string) {
 			defer wg.Done()
-			processStat(&mu, name, pidMap)
+			info, ok := processStat(name)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			infos = append(infos, info)
 		}(proc.Name())
 	}
 
 	wg.Wait()
+	return infos, nil
+}
+
+// GetChildProcesses will return all child processes's pid. Include all generations.
+// only return error when /proc cannot be read
+func getChildProcesses(ppid uint64) ([]uint64, error) {
+	infos, err := listProcesses()
+	if err != nil {
+		return nil, fmt.Errorf("%v, ppid : %d", err, ppid)
+	}
+
+	pidMap := make(map[uint64][]uint64) // Map of parent PID to child PIDs
+	for _, info := range infos {
+		pidMap[info.ppid] = append(pidMap[info.ppid], info.pid)
+	}
 
 	// Collect all child PIDs recursively starting from the given ppid.
 	result := collectAllChildren(ppid, pidMap)
@@ -138,31 +413,38 @@ func collectAllChildren(ppid uint64, pidMap map[uint64][]uint64) []uint64 {
 	return result
 }
 
-// processStat parses a process's stat file and updates the pidMap with parent-child relationships.
-func processStat(mu *sync.Mutex, name string, pidMap map[uint64][]uint64) {
+// processStat parses a process's stat file, it returns false if name is not a
+// process or the process has exited.
+func processStat(name string) (procInfo, bool) {
 	_pid, err := strconv.ParseUint(name, 10, 64)
 	if err != nil {
-		return
+		return procInfo{}, false
 	}
 
 	statusPath := filepath.Join(DefaultProcPrefix, name, "stat")
-	reader, err := os.Open(statusPath)
+	stat, err := os.ReadFile(statusPath)
 	if err != nil {
-		return
+		return procInfo{}, false
 	}
-	defer reader.Close()
 
+	// according to procfs's man page, comm is in parentheses and may contain
+	// spaces, state and ppid follow it
+	start := strings.IndexByte(string(stat), '(')
+	end := strings.LastIndexByte(string(stat), ')')
+	if start < 0 || end < start {
+		return procInfo{}, false
+	}
 	var (
-		ppid  uint64
-		comm  string
 		state string
+		ppid  uint64
 	)
-	// according to procfs's man page
-	_, err = fmt.Fscanf(reader, "%d %s %s %d", &_pid, &comm, &state, &ppid)
+	_, err = fmt.Sscanf(string(stat[end+1:]), "%s %d", &state, &ppid)
 	if err != nil {
-		return
+		return procInfo{}, false
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	pidMap[ppid] = append(pidMap[ppid], _pid)
+	return procInfo{
+		pid:  _pid,
+		ppid: ppid,
+		comm: string(stat[start+1 : end]),
+	}, true
 }
@@ -0,0 +1,206 @@
+package watchmaker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// fakeImageMagic marks the beginning of an injected fake image
+var fakeImageMagic = [8]byte{'W', 'M', 'K', 'R', 'I', 'M', 'G', 0}
+
+// fakeImageVersion is increased every time the layout of the header or the fake image changes
+const fakeImageVersion = 5
+
+const (
+	maxHeaderSymbolName = 32
+	maxHeaderOriginCode = 32
+	maxHeaderVariables  = 16
+	maxHeaderAliases    = 4
+)
+
+// rawFakeImageHeader is how FakeImageHeader is stored in the target process
+type rawFakeImageHeader struct {
+	Magic            [8]byte
+	Version          uint32
+	HeaderLength     uint32
+	ContentLength    uint32
+	VariableCount    uint32
+	OriginAddress    uint64
+	SymbolName       [maxHeaderSymbolName]byte
+	OriginCodeLength uint32
+	_                uint32
+	OriginCode       [maxHeaderOriginCode]byte
+	Variables        [maxHeaderVariables]rawFakeImageVariable
+	AliasCount       uint32
+	_                uint32
+	Aliases          [maxHeaderAliases]rawFakeImageAlias
+}
+
+type rawFakeImageVariable struct {
+	Name   [maxHeaderSymbolName]byte
+	Offset uint32
+	Length uint32
+}
+
+type rawFakeImageAlias struct {
+	Address    uint64
+	CodeLength uint32
+	_          uint32
+	Code       [maxHeaderOriginCode]byte
+}
+
+// fakeImageHeaderSize is the size of the header in front of the fake image, it is
+// rounded up to 16 bytes to keep the code aligned
+var fakeImageHeaderSize = uint64((binary.Size(rawFakeImageHeader{}) + 15) &^ 15)
+
+// FakeImageHeader is written in front of the fake image in the target process,
+// so any watchmaker process could find the injected image, update its variables
+// or recover the origin function.
+type FakeImageHeader struct {
+	// SymbolName is the name of the replaced symbol.
+	SymbolName string
+	// ContentLength is the length of the fake image without header.
+	ContentLength uint64
+	// OriginAddress is the address of the replaced function.
+	OriginAddress uint64
+	// OriginFuncCode is the origin code overwritten by the jump.
+	OriginFuncCode []byte
+	// Variables is the offset of every extern variable within the fake image.
+	Variables map[string]int
+	// VarLengths is the length of every extern variable.
+	VarLengths map[string]int
+	// Aliases are the other addresses of the replaced symbol which jump to the
+	// fake image too, see vdsoSymbolAliases.
+	Aliases []FakeImageAlias
+}
+
+// FakeImageAlias is an alias of the replaced symbol at a different address
+type FakeImageAlias struct {
+	// Address is the address of the alias.
+	Address uint64
+	// OriginFuncCode is the origin code overwritten by the jump.
+	OriginFuncCode []byte
+}
+
+// Encode returns the binary header with the length of fakeImageHeaderSize
+func (h *FakeImageHeader) Encode() ([]byte, error) {
+	if len(h.SymbolName) >= maxHeaderSymbolName {
+		return nil, fmt.Errorf("symbol name %s is too long", h.SymbolName)
+	}
+	if len(h.OriginFuncCode) > maxHeaderOriginCode {
+		return nil, fmt.Errorf("origin code of %s is too long: %d", h.SymbolName, len(h.OriginFuncCode))
+	}
+	if len(h.Variables) > maxHeaderVariables {
+		return nil, fmt.Errorf("too many variables in %s: %d", h.SymbolName, len(h.Variables))
+	}
+	if len(h.Aliases) > maxHeaderAliases {
+		return nil, fmt.Errorf("too many aliases of %s: %d", h.SymbolName, len(h.Aliases))
+	}
+
+	raw := rawFakeImageHeader{
+		Magic:            fakeImageMagic,
+		Version:          fakeImageVersion,
+		HeaderLength:     uint32(fakeImageHeaderSize),
+		ContentLength:    uint32(h.ContentLength),
+		VariableCount:    uint32(len(h.Variables)),
+		OriginAddress:    h.OriginAddress,
+		OriginCodeLength: uint32(len(h.OriginFuncCode)),
+		AliasCount:       uint32(len(h.Aliases)),
+	}
+	copy(raw.SymbolName[:], h.SymbolName)
+	copy(raw.OriginCode[:], h.OriginFuncCode)
+	for i, alias := range h.Aliases {
+		if len(alias.OriginFuncCode) > maxHeaderOriginCode {
+			return nil, fmt.Errorf("origin code of %s alias at %#x is too long: %d", h.SymbolName, alias.Address, len(alias.OriginFuncCode))
+		}
+		raw.Aliases[i].Address = alias.Address
+		raw.Aliases[i].CodeLength = uint32(len(alias.OriginFuncCode))
+		copy(raw.Aliases[i].Code[:], alias.OriginFuncCode)
+	}
+
+	// sort the variables to make the header stable
+	names := make([]string, 0, len(h.Variables))
+	for name := range h.Variables {
+		if len(name) >= maxHeaderSymbolName {
+			return nil, fmt.Errorf("variable name %s is too long", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		copy(raw.Variables[i].Name[:], name)
+		raw.Variables[i].Offset = uint32(h.Variables[name])
+		length, ok := h.VarLengths[name]
+		if !ok || length <= 0 || length > maxVarLength {
+			return nil, fmt.Errorf("invalid length of variable %s: %d", name, length)
+		}
+		raw.Variables[i].Length = uint32(length)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, fakeImageHeaderSize))
+	err := binary.Write(buf, endian, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf.Bytes(), make([]byte, int(fakeImageHeaderSize)-buf.Len())...), nil
+}
+
+// DecodeFakeImageHeader parses the header read from the target process
+func DecodeFakeImageHeader(data []byte) (*FakeImageHeader, error) {
+	var raw rawFakeImageHeader
+	if uint64(len(data)) < fakeImageHeaderSize {
+		return nil, fmt.Errorf("fake image header too short: %d", len(data))
+	}
+	err := binary.Read(bytes.NewReader(data), endian, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw.Magic != fakeImageMagic {
+		return nil, fmt.Errorf("fake image header magic not found")
+	}
+	if raw.Version != fakeImageVersion {
+		return nil, fmt.Errorf("unsupported fake image version %d, expected %d", raw.Version, fakeImageVersion)
+	}
+	if uint64(raw.HeaderLength) != fakeImageHeaderSize {
+		return nil, fmt.Errorf("unexpected fake image header length %d", raw.HeaderLength)
+	}
+	if raw.OriginCodeLength > maxHeaderOriginCode || raw.VariableCount > maxHeaderVariables || raw.AliasCount > maxHeaderAliases {
+		return nil, fmt.Errorf("corrupted fake image header")
+	}
+
+	h := &FakeImageHeader{
+		SymbolName:     cString(raw.SymbolName[:]),
+		ContentLength:  uint64(raw.ContentLength),
+		OriginAddress:  raw.OriginAddress,
+		OriginFuncCode: append([]byte(nil), raw.OriginCode[:raw.OriginCodeLength]...),
+		Variables:      make(map[string]int, raw.VariableCount),
+		VarLengths:     make(map[string]int, raw.VariableCount),
+	}
+	for _, v := range raw.Variables[:raw.VariableCount] {
+		if v.Length == 0 || v.Length > maxVarLength || uint64(v.Offset)+uint64(v.Length) > h.ContentLength {
+			return nil, fmt.Errorf("corrupted fake image header")
+		}
+		h.Variables[cString(v.Name[:])] = int(v.Offset)
+		h.VarLengths[cString(v.Name[:])] = int(v.Length)
+	}
+	for _, alias := range raw.Aliases[:raw.AliasCount] {
+		if alias.CodeLength > maxHeaderOriginCode {
+			return nil, fmt.Errorf("corrupted fake image header")
+		}
+		h.Aliases = append(h.Aliases, FakeImageAlias{
+			Address:        alias.Address,
+			OriginFuncCode: append([]byte(nil), alias.Code[:alias.CodeLength]...),
+		})
+	}
+	return h, nil
+}
+
+// cString returns the string before the first NUL
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
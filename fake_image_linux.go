@@ -1,45 +1,150 @@
 package watchmaker
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"runtime"
+
+	"golang.org/x/sys/unix"
 )
 
 // vdsoEntryName is the name of the vDSO entry
 const vdsoEntryName = "[vdso]"
 
+// StopMode is how many threads of a process are stopped while injecting
+type StopMode string
+
+const (
+	// StopModeAll stops every thread from attaching to detaching
+	StopModeAll StopMode = "all"
+	// StopModeMinimal stops only the main thread while the image is mapped and
+	// written, the other threads are stopped only while the jumps are written
+	// into vDSO. The mode applies to injecting new images only, every thread is
+	// stopped while the variables of an injected image are written by Inject or
+	// Update, and while the images are removed by Recover.
+	StopModeMinimal StopMode = "minimal"
+)
+
+// ParseStopMode returns the stop mode named s
+func ParseStopMode(s string) (StopMode, error) {
+	switch StopMode(s) {
+	case StopModeAll, StopModeMinimal:
+		return StopMode(s), nil
+	}
+	return "", fmt.Errorf("unknown stop mode %s, expected %s or %s", s, StopModeAll, StopModeMinimal)
+}
+
+// traceWithMode ptrace the threads of the process stopped from the beginning in
+// mode, the program logs to l
+func traceWithMode(pid int, mode StopMode, l *slog.Logger) (*TracedProgram, error) {
+	if mode == StopModeMinimal {
+		return traceMainThread(pid, l)
+	}
+	return trace(pid, l)
+}
+
 // FakeImage introduce the replacement of VDSO ELF entry and customizable variables.
 // FakeImage could be constructed by LoadFakeImageFromEmbedFs(), and then used by FakeClockInjector.
 type FakeImage struct {
 	// symbolName is the name of the symbol to be replaced.
 	symbolName string
-	// content presents .text section which has been "manually relocation", the address of extern variables have been calculated manually
+	// content presents the loaded sections and the variables, which are relocated
+	// by link when the address of the image is known
 	content []byte
 	// offset stores the table with variable name, and it's address in content.
 	// the key presents extern variable name, ths value is the address/offset within the content.
 	offset map[string]int
+	// lengths stores the length of variables, a variable is 8 bytes if missing.
+	lengths map[string]int
+	// relocations are applied to content by link.
+	relocations []imageRelocation
+	// dataOffset is the beginning of the writable part of content, the part
+	// before it is made read only and executable after it is written.
+	dataOffset uint64
+	// stopMode is StopModeAll unless it is set by Skew.SetStopMode
+	stopMode StopMode
+	// logger is nil unless it is set by Skew.SetLogger
+	logger *slog.Logger
 	// OriginFuncCode stores the raw func code like getTimeOfDay & ClockGetTime.
 	OriginFuncCode []byte
 	// OriginAddress stores the origin address of OriginFuncCode.
 	OriginAddress uint64
+	// aliases stores the origin code of the other aliases of the symbol.
+	aliases []FakeImageAlias
 	// fakeEntry stores the fake entry
 	fakeEntry *Entry
+	// header stores the header in front of the injected fake entry
+	header *FakeImageHeader
 }
 
 func NewFakeImage(symbolName string, content []byte, offset map[string]int) *FakeImage {
 	return &FakeImage{symbolName: symbolName, content: content, offset: offset}
 }
 
+// clone returns a FakeImage with the same content which is not injected yet
+func (it *FakeImage) clone() *FakeImage {
+	image := NewFakeImage(it.symbolName, it.content, it.offset)
+	image.lengths = it.lengths
+	image.relocations = it.relocations
+	image.dataOffset = it.dataOffset
+	image.stopMode = it.stopMode
+	image.logger = it.logger
+	return image
+}
+
+// log returns the logger of the image
+func (it *FakeImage) log() *slog.Logger {
+	return loggerOr(it.logger)
+}
+
+// link returns the content relocated to be mapped at base
+func (it *FakeImage) link(base uint64) ([]byte, error) {
+	content := append([]byte(nil), it.content...)
+	for _, r := range it.relocations {
+		err := applyRelocation(content, r, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// varLengths returns the length of every variable
+func (it *FakeImage) varLengths() map[string]int {
+	lengths := make(map[string]int, len(it.offset))
+	for name := range it.offset {
+		lengths[name] = externVarLength
+		if length, ok := it.lengths[name]; ok {
+			lengths[name] = length
+		}
+	}
+	return lengths
+}
+
+// SetVarUint64 writes value to the variable of the injected image, a variable
+// shorter than 8 bytes gets the low bytes of value
+func (it *FakeImage) SetVarUint64(program *TracedProgram, entry *Entry, symbol string, value uint64) error {
+	offset, length, ok := it.varOffset(symbol)
+	if !ok {
+		return fmt.Errorf("symbol not found")
+	}
+	data := make([]byte, 8)
+	endian.PutUint64(data, value)
+	return program.WriteSlice(entry.StartAddress+uint64(offset), data[:length])
+}
+
 // AttachToProcess would use ptrace to replace the VDSO ELF entry with FakeImage.
 // Each item in parameter "variables" needs a corresponding entry in FakeImage.offset.
 func (it *FakeImage) AttachToProcess(pid int, variables map[string]uint64) error {
-	log.Printf("%s: got %d variables (%d in offset)", it.symbolName, len(variables), len(it.offset))
+	return it.attachToProcess(context.Background(), pid, variables)
+}
 
-	for k, v := range it.offset {
-		log.Printf("%s: %s=%d", it.symbolName, k, v)
-	}
+// attachToProcess is AttachToProcess, which gives up between the phases of
+// injecting if ctx is done. The image is removed if it is injected already.
+func (it *FakeImage) attachToProcess(ctx context.Context, pid int, variables map[string]uint64) error {
+	it.log().Debug("attaching fake image", "symbol", it.symbolName, "variables", len(variables), "offsets", it.offset)
 	if len(variables) != len(it.offset) {
 		return fmt.Errorf("fake image: extern variable number not match")
 	}
@@ -49,50 +154,117 @@ func (it *FakeImage) AttachToProcess(pid int, variables map[string]uint64) error
 		runtime.UnlockOSThread()
 	}()
 
-	program, err := Trace(pid)
+	program, err := traceWithMode(pid, it.stopMode, it.logger)
 	if err != nil {
-		return fmt.Errorf("%v ptrace on target process, pid: %d", err, pid)
+		return fmt.Errorf("%w ptrace on target process, pid: %d", err, pid)
 	}
 	defer func() {
 		err = program.Detach()
 		if err != nil {
-			log.Println(err, "fail to detach program", "pid", pid)
+			it.log().Warn("fail to detach program", "pid", pid, "error", err)
 		}
 	}()
+	program.SetContext(ctx)
 
 	vdsoEntry, err := FindVDSOEntry(program)
 	if err != nil {
-		return fmt.Errorf("%v PID : %d", err, pid)
+		return fmt.Errorf("%w PID : %d", err, pid)
 	}
 
 	fakeEntry, err := it.FindInjectedImage(program, len(variables))
 	if err != nil {
-		return fmt.Errorf("%v PID : %d", err, pid)
+		return fmt.Errorf("%w PID : %d", err, pid)
 	}
 	// target process has not been injected yet
 	if fakeEntry == nil {
-		log.Println("injecting", it.symbolName, "to pid", pid)
+		err = program.Err()
+		if err != nil {
+			return fmt.Errorf("%w before injecting %s, PID : %d", err, it.symbolName, pid)
+		}
+		it.log().Info("injecting", "symbol", it.symbolName, "pid", pid)
 		fakeEntry, err = it.InjectFakeImage(program, vdsoEntry)
 		if err != nil {
-			return fmt.Errorf("%v injecting fake image, PID : %d", err, pid)
+			return fmt.Errorf("%w injecting fake image, PID : %d", err, pid)
 		}
 		defer func() {
 			if err != nil {
 				errIn := it.TryReWriteFakeImage(program)
 				if errIn != nil {
-					log.Println(errIn, "rewrite fail, recover fail")
+					it.log().Warn("rewrite fail, recover fail", "symbol", it.symbolName, "error", errIn)
 				}
 				it.OriginFuncCode = nil
 				it.OriginAddress = 0
+				it.aliases = nil
+				it.fakeEntry = nil
+				it.header = nil
 			}
 		}()
+	} else {
+		it.log().Info("updating variables of injected image", "symbol", it.symbolName, "pid", pid)
+		// the injected image may be running in the other threads, which must not
+		// read the variables between the writes, see updateVariables
+		err = program.StopAllThreads()
+		if err != nil {
+			return fmt.Errorf("%w stop all threads, PID : %d", err, pid)
+		}
 	}
 
 	for k, v := range variables {
 		err = it.SetVarUint64(program, fakeEntry, k, v)
 
 		if err != nil {
-			return fmt.Errorf("%v set %s for time skew, pid: %d", err, k, pid)
+			return fmt.Errorf("%w set %s for time skew, pid: %d", err, k, pid)
+		}
+	}
+	program.Mark("set variables of " + it.symbolName)
+
+	return nil
+}
+
+// UpdateVariables rewrites the variables of the image injected before, the
+// origin function in vDSO is not touched. It returns error if the image is not
+// found in the process.
+func (it *FakeImage) UpdateVariables(pid int, variables map[string]uint64) error {
+	return it.updateVariables(context.Background(), pid, variables)
+}
+
+// updateVariables is UpdateVariables, which gives up before writing the
+// variables if ctx is done
+func (it *FakeImage) updateVariables(ctx context.Context, pid int, variables map[string]uint64) error {
+	runtime.LockOSThread()
+	defer func() {
+		runtime.UnlockOSThread()
+	}()
+
+	// every thread is stopped even in StopModeMinimal, as the variables are
+	// written one by one, and a thread reading TV_SEC_DELTA and TV_NSEC_DELTA
+	// between the writes would see a time which is neither the old nor the new one
+	program, err := trace(pid, it.logger)
+	if err != nil {
+		return fmt.Errorf("%w ptrace on target process, pid: %d", err, pid)
+	}
+	defer func() {
+		err = program.Detach()
+		if err != nil {
+			it.log().Warn("fail to detach program", "pid", pid, "error", err)
+		}
+	}()
+
+	fakeEntry, err := it.FindInjectedImage(program, len(variables))
+	if err != nil {
+		return fmt.Errorf("%w PID : %d", err, pid)
+	}
+	if fakeEntry == nil {
+		return fmt.Errorf("%w, %s has not been injected, pid: %d", ErrNotInjected, it.symbolName, pid)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w before updating %s, pid: %d", ctx.Err(), it.symbolName, pid)
+	}
+
+	for k, v := range variables {
+		err = it.SetVarUint64(program, fakeEntry, k, v)
+		if err != nil {
+			return fmt.Errorf("%w set %s for time skew, pid: %d", err, k, pid)
 		}
 	}
 
@@ -116,104 +288,506 @@ func FindVDSOEntry(program *TracedProgram) (*Entry, error) {
 }
 
 // FindInjectedImage find injected image to avoid redundant inject.
+// The jump written into the vDSO is followed to the FakeImageHeader in front of
+// the image, so the image could be found even if it was injected by another
+// watchmaker process. The variables are written by the offsets in the header,
+// so it returns error if the image has other variables than varNum.
 func (it *FakeImage) FindInjectedImage(program *TracedProgram, varNum int) (*Entry, error) {
-	// minus tailing variable part
-	// every variable has 8 bytes
-	if it.fakeEntry != nil {
-		content, err := program.ReadSlice(it.fakeEntry.StartAddress, it.fakeEntry.EndAddress-it.fakeEntry.StartAddress)
+	header, fakeEntry, err := it.findInjectedImage(program)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	if len(header.Variables) != varNum {
+		return nil, fmt.Errorf("injected %s has %d variables, expected %d", it.symbolName, len(header.Variables), varNum)
+	}
+	it.useInjectedImage(header, fakeEntry)
+	return fakeEntry, nil
+}
+
+// findInjectedImage reads the header of the image of the symbol injected to the
+// process, the image may be built from another object than it
+func (it *FakeImage) findInjectedImage(program *TracedProgram) (*FakeImageHeader, *Entry, error) {
+	header, fakeEntry, err := it.readInjectedImage(program)
+	if err != nil || header == nil {
+		return nil, nil, err
+	}
+	if header.SymbolName != it.symbolName {
+		return nil, nil, fmt.Errorf("%s jumps to the fake image of %s", it.symbolName, header.SymbolName)
+	}
+	it.log().Debug("found injected image", "symbol", it.symbolName, "address", fmt.Sprintf("%#x", fakeEntry.StartAddress))
+	return header, fakeEntry, nil
+}
+
+// useInjectedImage takes the origin code kept in the header of the injected
+// image, which is restored by TryReWriteFakeImage
+func (it *FakeImage) useInjectedImage(header *FakeImageHeader, fakeEntry *Entry) {
+	it.header = header
+	it.fakeEntry = fakeEntry
+	it.OriginFuncCode = header.OriginFuncCode
+	it.OriginAddress = header.OriginAddress
+	it.aliases = header.Aliases
+}
+
+// Injected returns true if the image has been injected to the process. Only
+// the memory of the process is read, so it doesn't need to be stopped. A process
+// loses the injected image after exec, as a fresh vDSO is mapped by the kernel.
+func (it *FakeImage) Injected(pid int) (bool, error) {
+	entries, err := ReadMaps(pid)
+	if err != nil {
+		return false, err
+	}
+	program := &TracedProgram{pid: pid, Entries: entries, logger: it.logger}
+
+	header, _, err := it.readInjectedImage(program)
+	if err != nil {
+		return false, fmt.Errorf("%w PID : %d", err, pid)
+	}
+	return header != nil, nil
+}
+
+// status reads the image injected to the process and its variables. Only the
+// memory of the process is read, so it doesn't need to be stopped.
+func (it *FakeImage) status(pid int) (ImageStatus, error) {
+	status := ImageStatus{Symbol: it.symbolName}
+	entries, err := ReadMaps(pid)
+	if err != nil {
+		return status, err
+	}
+	program := &TracedProgram{pid: pid, Entries: entries, logger: it.logger}
+
+	header, fakeEntry, err := it.readInjectedImage(program)
+	if err != nil {
+		return status, fmt.Errorf("%w PID : %d", err, pid)
+	}
+	if header == nil {
+		return status, nil
+	}
+	status.Injected = true
+	status.Address = fakeEntry.StartAddress
+	status.Variables = make(map[string]uint64, len(header.Variables))
+	for name, offset := range header.Variables {
+		length := header.VarLengths[name]
+		if length == 0 {
+			length = externVarLength
+		}
+		data, err := program.ReadSlice(fakeEntry.StartAddress+uint64(offset), uint64(length))
 		if err != nil {
-			log.Println("ReadSlice fail")
-			return nil, nil
+			return status, fmt.Errorf("%w read %s of %s, PID : %d", err, name, it.symbolName, pid)
 		}
-		if varNum*8 > len(it.content) {
-			return nil, fmt.Errorf("variable num bigger than content num")
+		value := make([]byte, 8)
+		copy(value, *data)
+		status.Variables[name] = endian.Uint64(value)
+	}
+	return status, nil
+}
+
+// readInjectedImage looks for the injected image from every alias of the symbol,
+// as an alias which jumps to another alias is not patched, see planPatches.
+func (it *FakeImage) readInjectedImage(program *TracedProgram) (*FakeImageHeader, *Entry, error) {
+	vdsoEntry, err := FindVDSOEntry(program)
+	if err != nil {
+		return nil, nil, err
+	}
+	locations, err := program.FindSymbolsInEntry(it.symbolName, vdsoEntry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w find origin %s in vdso", err, it.symbolName)
+	}
+	for _, location := range locations {
+		header, fakeEntry, err := ReadInjectedImage(program, location.Address)
+		if err != nil || header != nil {
+			return header, fakeEntry, err
 		}
-		contentWithoutVariable := (*content)[:len(it.content)-varNum*varLength]
-		expectedContentWithoutVariable := it.content[:len(it.content)-varNum*varLength]
-		log.Println("successfully read slice", "content", contentWithoutVariable, "expected content", expectedContentWithoutVariable)
+	}
+	return nil, nil, nil
+}
 
-		if bytes.Equal(contentWithoutVariable, expectedContentWithoutVariable) {
-			log.Println("slice found")
-			return it.fakeEntry, nil
+// ReadInjectedImage reads the beginning of the function at originAddr, and if it is
+// a jump written by JumpToFakeFunc or RelJumpToFakeFunc, reads the FakeImageHeader
+// of the jump target. It returns nil if the function has not been replaced. The
+// origin code of vDSO may be a relative jump too, so a relative jump to anything
+// but a fake image is not an error. Only process_vm_readv is used, so the program
+// doesn't need to be stopped. The privilege of the entry is the one of the
+// mapping holding the code, the data after it is mapped rw-p.
+func ReadInjectedImage(program *TracedProgram, originAddr uint64) (*FakeImageHeader, *Entry, error) {
+	code, err := program.ReadSlice(originAddr, jumpInstrSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w ReadSlice failed", err)
+	}
+	targetAddr, relative, ok := ParseJumpToFakeFunc(*code, originAddr)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	headerAddr := targetAddr - fakeImageHeaderSize
+	mapped := false
+	privilege := ""
+	for _, e := range program.Entries {
+		if e.StartAddress <= headerAddr && targetAddr <= e.EndAddress {
+			mapped = true
+			privilege = e.Privilege
+			break
 		}
-		log.Println("slice not found")
 	}
-	return nil, nil
+	if !mapped && relative {
+		return nil, nil, nil
+	}
+	if !mapped {
+		return nil, nil, fmt.Errorf("function at %#x jumps to unmapped address %#x", originAddr, targetAddr)
+	}
+
+	data, err := program.ReadSlice(headerAddr, fakeImageHeaderSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w ReadSlice failed", err)
+	}
+	header, err := DecodeFakeImageHeader(*data)
+	if err != nil && relative {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w, function at %#x jumps to an unknown image at %#x", err, originAddr, targetAddr)
+	}
+	belongs := header.OriginAddress == originAddr
+	for _, alias := range header.Aliases {
+		belongs = belongs || alias.Address == originAddr
+	}
+	if !belongs {
+		return nil, nil, fmt.Errorf("fake image at %#x belongs to function at %#x, not %#x", targetAddr, header.OriginAddress, originAddr)
+	}
+
+	return header, &Entry{
+		StartAddress: targetAddr,
+		EndAddress:   targetAddr + header.ContentLength,
+		Privilege:    privilege,
+		PaddingSize:  0,
+		Path:         "",
+	}, nil
+}
+
+// patchKind is how a location of the symbol is redirected to the fake image
+type patchKind int
+
+const (
+	// patchAbsolute writes the jump of JumpToFakeFunc
+	patchAbsolute patchKind = iota
+	// patchRelative writes the shorter jump of RelJumpToFakeFunc, the image must be
+	// mapped within relJumpRange
+	patchRelative
+	// patchSkip leaves a location which jumps to another patched location alone
+	patchSkip
+)
+
+// symbolPatch is the plan of patching a location of the symbol
+type symbolPatch struct {
+	location SymbolLocation
+	kind     patchKind
+}
+
+// length returns the length of the origin code overwritten by the patch
+func (p symbolPatch) length() uint64 {
+	switch p.kind {
+	case patchAbsolute:
+		return jumpInstrSize
+	case patchRelative:
+		return relJumpInstrSize
+	}
+	return 0
+}
+
+// planPatches decides how every location is patched without overwriting the
+// code after the end of the function. A function smaller than the absolute jump
+// gets a relative jump, or is skipped if it is only a jump to another location
+// which is patched. It refuses if a function is too small for both.
+func planPatches(program *TracedProgram, locations []SymbolLocation) ([]symbolPatch, error) {
+	patches := make([]symbolPatch, len(locations))
+	patched := make(map[uint64]bool, len(locations))
+	for i, location := range locations {
+		patches[i].location = location
+		switch {
+		case location.Size >= jumpInstrSize:
+			patches[i].kind = patchAbsolute
+		case location.Size >= relJumpInstrSize:
+			patches[i].kind = patchRelative
+		default:
+			patches[i].kind = patchSkip
+		}
+		if patches[i].kind != patchSkip {
+			patched[location.Address] = true
+		}
+	}
+
+	for i := range patches {
+		if patches[i].kind == patchAbsolute {
+			continue
+		}
+		location := patches[i].location
+		code, err := program.ReadSlice(location.Address, relJumpInstrSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w ReadSlice failed", err)
+		}
+		target, relative, ok := ParseJumpToFakeFunc(*code, location.Address)
+		if ok && relative && target != location.Address && patched[target] {
+			program.log().Debug("alias is redirected through the target", "symbol", location.Name, "address", fmt.Sprintf("%#x", location.Address), "target", fmt.Sprintf("%#x", target))
+			patches[i].kind = patchSkip
+			continue
+		}
+		if patches[i].kind == patchSkip {
+			return nil, fmt.Errorf("%s at %#x has only %d bytes, a jump to the fake image needs %d bytes",
+				location.Name, location.Address, location.Size, relJumpInstrSize)
+		}
+	}
+
+	for _, patch := range patches {
+		if patch.kind != patchSkip {
+			return patches, nil
+		}
+	}
+	return nil, fmt.Errorf("every alias of %s jumps to another alias", locations[0].Name)
 }
 
 // InjectFakeImage Usage CheckList:
 // When error : TryReWriteFakeImage after InjectFakeImage.
+// Every alias of the symbol at a different address jumps to the fake image.
 func (it *FakeImage) InjectFakeImage(program *TracedProgram,
 	vdsoEntry *Entry) (*Entry, error) {
-	fakeEntry, err := program.MmapSlice(it.content)
+	locations, err := program.FindSymbolsInEntry(it.symbolName, vdsoEntry)
 	if err != nil {
-		return nil, fmt.Errorf("%v mmap fake image", err)
+		return nil, fmt.Errorf("%w find origin %s in vdso", err, it.symbolName)
 	}
-	it.fakeEntry = fakeEntry
-	originAddr, size, err := program.FindSymbolInEntry(it.symbolName, vdsoEntry)
+	for _, location := range locations {
+		it.log().Debug("origin", "symbol", location.Name, "size", location.Size, "address", fmt.Sprintf("%#x", location.Address))
+	}
+	allPatches, err := planPatches(program, locations)
 	if err != nil {
-		return nil, fmt.Errorf("%v find origin %s in vdso", err, it.symbolName)
+		return nil, fmt.Errorf("%w, refuse to replace %s", err, it.symbolName)
+	}
+
+	// only the code overwritten by the jump is saved, the code after the end of a
+	// small function must not be touched when it is restored
+	var patches []symbolPatch
+	var codes [][]byte
+	var nearAddr uint64
+	relative := false
+	for _, patch := range allPatches {
+		if patch.kind == patchSkip {
+			continue
+		}
+		funcBytes, err := program.ReadSlice(patch.location.Address, patch.length())
+		if err != nil {
+			return nil, fmt.Errorf("%w ReadSlice failed", err)
+		}
+		if patch.kind == patchRelative && !relative {
+			relative = true
+			nearAddr = patch.location.Address
+		}
+		patches = append(patches, patch)
+		codes = append(codes, *funcBytes)
 	}
+	originAddr := patches[0].location.Address
 
-	funcBytes, err := program.ReadSlice(originAddr, size)
+	var aliases []FakeImageAlias
+	for i, patch := range patches[1:] {
+		aliases = append(aliases, FakeImageAlias{
+			Address:        patch.location.Address,
+			OriginFuncCode: codes[i+1],
+		})
+	}
+
+	header := &FakeImageHeader{
+		SymbolName:     it.symbolName,
+		ContentLength:  uint64(len(it.content)),
+		OriginAddress:  originAddr,
+		OriginFuncCode: codes[0],
+		Variables:      it.offset,
+		VarLengths:     it.varLengths(),
+		Aliases:        aliases,
+	}
+	headerBytes, err := header.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("%w encode fake image header", err)
+	}
+
+	size := fakeImageHeaderSize + uint64(len(it.content))
+	var imageAddr uint64
+	if relative {
+		// the locations are all in vDSO, so the image near one of them is within
+		// the range of the others too, which is checked by RelJumpToFakeFunc
+		imageAddr, err = program.MmapNear(size, nearAddr, relJumpRange)
+	} else {
+		imageAddr, err = program.Mmap(size, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w mmap fake image", err)
+	}
+	program.Mark("mmap " + it.symbolName)
+	fakeEntry := &Entry{
+		StartAddress: imageAddr + fakeImageHeaderSize,
+		EndAddress:   imageAddr + size,
+		Privilege:    "r-xp",
+		PaddingSize:  0,
+		Path:         "",
+	}
+
+	// the image is relocated after it is mapped, as the relocations depend on
+	// the address of the image. It is mapped writable, and the header and the
+	// code are made executable but not writable after they are written, as a
+	// mapping both writable and executable is denied by hardened kernels.
+	content, err := it.link(fakeEntry.StartAddress)
+	if err == nil {
+		err = program.WriteSlice(imageAddr, append(headerBytes, content...))
+	}
+	if err == nil {
+		err = program.Mprotect(imageAddr, fakeImageHeaderSize+it.dataOffset, unix.PROT_READ|unix.PROT_EXEC)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("%v ReadSlice failed", err)
+		errIn := program.Munmap(imageAddr, size)
+		if errIn != nil {
+			it.log().Warn("unmap fake image fail", "symbol", it.symbolName, "error", errIn)
+		}
+		return nil, fmt.Errorf("%w write fake image", err)
+	}
+	it.header = header
+	it.fakeEntry = fakeEntry
+	// the origin code is set before writing the jumps, so TryReWriteFakeImage
+	// restores the aliases already written if a later one fails
+	it.OriginFuncCode = codes[0]
+	it.OriginAddress = originAddr
+	it.aliases = aliases
+	program.Mark("write " + it.symbolName)
+
+	// the other threads may run the vDSO functions, so they are stopped before
+	// the jumps are written, if they are not yet
+	err = program.Err()
+	if err == nil {
+		err = program.StopAllThreads()
 	}
-	err = program.JumpToFakeFunc(originAddr, fakeEntry.StartAddress)
 	if err != nil {
 		errIn := it.TryReWriteFakeImage(program)
 		if errIn != nil {
-			log.Println(errIn, "rewrite fail, recover fail")
+			it.log().Warn("rewrite fail, recover fail", "symbol", it.symbolName, "error", errIn)
+		}
+		return nil, fmt.Errorf("%w stop all threads", err)
+	}
+	for _, patch := range patches {
+		if patch.kind == patchRelative {
+			err = program.RelJumpToFakeFunc(patch.location.Address, fakeEntry.StartAddress)
+		} else {
+			err = program.JumpToFakeFunc(patch.location.Address, fakeEntry.StartAddress)
+		}
+		if err != nil {
+			errIn := it.TryReWriteFakeImage(program)
+			if errIn != nil {
+				it.log().Warn("rewrite fail, recover fail", "symbol", it.symbolName, "error", errIn)
+			}
+			return nil, fmt.Errorf("%w override origin %s", err, patch.location.Name)
 		}
-		return nil, fmt.Errorf("%v override origin %s", err, it.symbolName)
 	}
+	program.Mark("patch " + it.symbolName)
 
-	it.OriginFuncCode = *funcBytes
-	it.OriginAddress = originAddr
 	return fakeEntry, nil
 }
 
+// varOffset returns the offset and length of variable within the injected image.
+// The table in header is preferred as the image may be injected by another
+// watchmaker process.
+func (it *FakeImage) varOffset(symbol string) (int, int, bool) {
+	if it.header != nil {
+		offset, ok := it.header.Variables[symbol]
+		return offset, it.header.VarLengths[symbol], ok
+	}
+	offset, ok := it.offset[symbol]
+	return offset, it.varLengths()[symbol], ok
+}
+
+// TryReWriteFakeImage restores the origin code of the symbol and all its aliases,
+// and unmaps the fake image once nothing jumps to it. Every location is restored
+// even if one of them fails, but the image is kept mapped then, as the location
+// not restored still jumps to it.
 func (it *FakeImage) TryReWriteFakeImage(program *TracedProgram) error {
+	var errs []error
+	var failed []FakeImageAlias
+	for i := len(it.aliases) - 1; i >= 0; i-- {
+		alias := it.aliases[i]
+		err := program.PtraceWriteSlice(alias.Address, alias.OriginFuncCode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w restore alias of %s at %#x", err, it.symbolName, alias.Address))
+			failed = append([]FakeImageAlias{alias}, failed...)
+		}
+	}
+	it.aliases = failed
 	if it.OriginFuncCode != nil {
 		err := program.PtraceWriteSlice(it.OriginAddress, it.OriginFuncCode)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("%w restore %s at %#x", err, it.symbolName, it.OriginAddress))
+		} else {
+			it.OriginFuncCode = nil
+			it.OriginAddress = 0
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if it.fakeEntry != nil {
+		// a thread may be stopped while it runs the image, e.g. in a busy loop
+		// of clock_gettime, it would crash when it is resumed after unmapping
+		err := program.StepOutOf(it.fakeEntry.StartAddress-fakeImageHeaderSize, it.fakeEntry.EndAddress)
+		if err != nil {
+			return fmt.Errorf("%w step out of fake image of %s", err, it.symbolName)
+		}
+		err = program.Munmap(it.fakeEntry.StartAddress-fakeImageHeaderSize,
+			it.fakeEntry.EndAddress-it.fakeEntry.StartAddress+fakeImageHeaderSize)
+		if err != nil {
+			return fmt.Errorf("%w unmap fake image of %s", err, it.symbolName)
 		}
-		it.OriginFuncCode = nil
-		it.OriginAddress = 0
+		it.fakeEntry = nil
+		it.header = nil
 	}
 	return nil
 }
 
 // Recover the injected image. If injected image not found ,
 // Recover will not return error.
-func (it *FakeImage) Recover(pid int, vars map[string]uint64) error {
+// The image is found even if it was injected by another watchmaker process or
+// built from another object, as only the header of the injected image is used,
+// and it is unmapped after the origin function code is restored, see
+// TryReWriteFakeImage.
+func (it *FakeImage) Recover(pid int) error {
+	return it.recover(context.Background(), pid)
+}
+
+// recover is Recover, which gives up before restoring the origin code if ctx is
+// done
+func (it *FakeImage) recover(ctx context.Context, pid int) error {
 	runtime.LockOSThread()
 	defer func() {
 		runtime.UnlockOSThread()
 	}()
-	if it.OriginFuncCode == nil {
-		return nil
-	}
-	program, err := Trace(pid)
+	program, err := trace(pid, it.logger)
 	if err != nil {
-		return fmt.Errorf("%T ptrace on target process, pid: %d", err, pid)
+		return fmt.Errorf("%w ptrace on target process, pid: %d", err, pid)
 	}
 	defer func() {
 		err = program.Detach()
 		if err != nil {
-			log.Println(err, "fail to detach program", "pid", program.Pid())
+			it.log().Warn("fail to detach program", "pid", program.Pid(), "error", err)
 		}
 	}()
 
-	fakeEntry, err := it.FindInjectedImage(program, len(vars))
+	header, fakeEntry, err := it.findInjectedImage(program)
 	if err != nil {
-		return fmt.Errorf("%T FindInjectedImage , pid: %d", err, pid)
+		return fmt.Errorf("%w FindInjectedImage , pid: %d", err, pid)
 	}
-	if fakeEntry == nil {
+	if header == nil {
 		return nil
 	}
+	it.useInjectedImage(header, fakeEntry)
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w before recovering %s, pid: %d", ctx.Err(), it.symbolName, pid)
+	}
 
 	err = it.TryReWriteFakeImage(program)
-	return err
+	if err != nil {
+		return fmt.Errorf("%w, pid: %d", err, pid)
+	}
+	return nil
 }
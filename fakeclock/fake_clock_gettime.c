@@ -5,6 +5,17 @@
 extern int64_t TV_SEC_DELTA;
 extern int64_t TV_NSEC_DELTA;
 extern uint64_t CLOCK_IDS_MASK;
+extern int64_t RATE_ANCHOR;
+extern int64_t RATE;
+
+extern uint64_t FAKE_MODE;
+
+/* RATE is a fixed-point number with 32 fractional bits */
+#define RATE_ONE ((int64_t)1 << 32)
+
+/* FAKE_MODE values, in MODE_FREEZE TV_SEC_DELTA and TV_NSEC_DELTA hold the frozen instant */
+#define MODE_OFFSET 0
+#define MODE_FREEZE 1
 
 #if defined(__amd64__)
 inline int real_clock_gettime(clockid_t clk_id, struct timespec *tp) {
@@ -35,6 +46,17 @@ inline int real_clock_gettime(clockid_t clk_id, struct timespec *tp) {
 }
 #endif
 
+/* scale the real time passed since RATE_ANCHOR by RATE, returns the extra nanoseconds */
+static inline int64_t rate_offset(int64_t real_ns)
+{
+    int64_t rate = RATE;
+    if (rate == 0 || rate == RATE_ONE) {
+        return 0;
+    }
+    __int128 elapsed = real_ns - RATE_ANCHOR;
+    return (int64_t)((elapsed * (rate - RATE_ONE)) >> 32);
+}
+
 int fake_clock_gettime(clockid_t clk_id, struct timespec *tp) {
     //printf("fake_clock_gettime() called\n");
     int ret = real_clock_gettime(clk_id, tp);
@@ -46,7 +68,25 @@ int fake_clock_gettime(clockid_t clk_id, struct timespec *tp) {
     int64_t billion = 1000000000;
 
     uint64_t clk_id_mask = 1 << clk_id;
-    if((clk_id_mask & clock_ids_mask) != 0) {
+    if((clk_id_mask & clock_ids_mask) != 0 && FAKE_MODE == MODE_FREEZE) {
+        tp->tv_sec = sec_delta;
+        tp->tv_nsec = nsec_delta;
+    } else if((clk_id_mask & clock_ids_mask) != 0) {
+        int64_t rate = RATE;
+        if (rate != 0 && rate != RATE_ONE) {
+            /* RATE_ANCHOR is a CLOCK_REALTIME value */
+            struct timespec now;
+            if (clk_id == CLOCK_REALTIME || clk_id == CLOCK_REALTIME_COARSE) {
+                now.tv_sec = tp->tv_sec;
+                now.tv_nsec = tp->tv_nsec;
+            } else {
+                real_clock_gettime(CLOCK_REALTIME, &now);
+            }
+            int64_t extra = rate_offset(now.tv_sec * billion + now.tv_nsec);
+            sec_delta += extra / billion;
+            nsec_delta += extra % billion;
+        }
+
         while (nsec_delta + tp->tv_nsec > billion) {
             sec_delta += 1;
             nsec_delta -= billion;
@@ -5,6 +5,17 @@
 
 extern int64_t TV_SEC_DELTA;
 extern int64_t TV_NSEC_DELTA;
+extern int64_t RATE_ANCHOR;
+extern int64_t RATE;
+
+extern uint64_t FAKE_MODE;
+
+/* RATE is a fixed-point number with 32 fractional bits */
+#define RATE_ONE ((int64_t)1 << 32)
+
+/* FAKE_MODE values, in MODE_FREEZE TV_SEC_DELTA and TV_NSEC_DELTA hold the frozen instant */
+#define MODE_OFFSET 0
+#define MODE_FREEZE 1
 
 #if defined(__amd64__)
 inline int real_gettimeofday(struct timeval *tv, struct timezone *tz)
@@ -43,6 +54,17 @@ static inline int64_t div_round_nearest(int64_t n, int64_t d)
     return (n >= 0) ? (n + d/2) / d : -(( -n + d/2) / d);
 }
 
+/* scale the real time passed since RATE_ANCHOR by RATE, returns the extra nanoseconds */
+static inline int64_t rate_offset(int64_t real_ns)
+{
+    int64_t rate = RATE;
+    if (rate == 0 || rate == RATE_ONE) {
+        return 0;
+    }
+    __int128 elapsed = real_ns - RATE_ANCHOR;
+    return (int64_t)((elapsed * (rate - RATE_ONE)) >> 32);
+}
+
 int fake_gettimeofday(struct timeval *tv, struct timezone *tz)
 {
     int ret = real_gettimeofday(tv, tz);
@@ -51,6 +73,17 @@ int fake_gettimeofday(struct timeval *tv, struct timezone *tz)
     int64_t nsec_delta = TV_NSEC_DELTA;
     int64_t billion = 1000000000;
 
+    if (FAKE_MODE == MODE_FREEZE)
+    {
+        tv->tv_sec = sec_delta;
+        tv->tv_usec = nsec_delta / 1000;
+        return ret;
+    }
+
+    int64_t extra = rate_offset(tv->tv_sec * billion + tv->tv_usec * 1000);
+    sec_delta += extra / billion;
+    nsec_delta += extra % billion;
+
     while (nsec_delta + tv->tv_usec*1000 > billion)
     {
         sec_delta += 1;
@@ -5,6 +5,17 @@
 
 extern int64_t TV_SEC_DELTA;
 extern int64_t TV_NSEC_DELTA;
+extern int64_t RATE_ANCHOR;
+extern int64_t RATE;
+
+extern uint64_t FAKE_MODE;
+
+/* RATE is a fixed-point number with 32 fractional bits */
+#define RATE_ONE ((int64_t)1 << 32)
+
+/* FAKE_MODE values, in MODE_FREEZE TV_SEC_DELTA and TV_NSEC_DELTA hold the frozen instant */
+#define MODE_OFFSET 0
+#define MODE_FREEZE 1
 
 #if defined(__amd64__)
 inline time_t real_time(time_t *t) {
@@ -17,18 +28,56 @@ inline time_t real_time(time_t *t) {
     );
     return (time_t)ret;
 }
+
+inline int real_gettimeofday(struct timeval *tv, struct timezone *tz)
+{
+    int ret;
+    asm volatile(
+        "syscall"
+        : "=a"(ret)
+        : "0"(__NR_gettimeofday), "D"(tv), "S"(tz)
+        : "rcx", "r11", "memory");
+
+    return ret;
+}
 #elif defined(__aarch64__)
 #error This is not supposed to be compiled on aarch64 targets as __NR_time is deprecated there.
 #endif
 
+/* scale the real time passed since RATE_ANCHOR by RATE, returns the extra nanoseconds */
+static inline int64_t rate_offset(int64_t real_ns)
+{
+    int64_t rate = RATE;
+    if (rate == 0 || rate == RATE_ONE) {
+        return 0;
+    }
+    __int128 elapsed = real_ns - RATE_ANCHOR;
+    return (int64_t)((elapsed * (rate - RATE_ONE)) >> 32);
+}
+
 time_t fake_time(time_t *t) {
     //printf("fake_time() called\n");
     time_t original_time = real_time(t);
 
     const int64_t sec_delta = TV_SEC_DELTA;
-    const int64_t nsec_delta = TV_NSEC_DELTA;
+    int64_t nsec_delta = TV_NSEC_DELTA;
     const int64_t billion = 1000000000;
 
+    if (FAKE_MODE == MODE_FREEZE) {
+        if (t) {
+            *t = sec_delta;
+        }
+        return sec_delta;
+    }
+
+    int64_t rate = RATE;
+    if (rate != 0 && rate != RATE_ONE) {
+        /* time() has no sub-second part, which is needed to scale the time smoothly */
+        struct timeval tv;
+        real_gettimeofday(&tv, NULL);
+        nsec_delta += rate_offset(tv.tv_sec * billion + tv.tv_usec * 1000);
+    }
+
     // 计算额外秒数和剩余纳秒
     int64_t extra_sec = nsec_delta / billion;
     int64_t remaining_nsec = nsec_delta % billion;
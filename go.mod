@@ -3,3 +3,5 @@ module github.com/busybox-org/watchmaker
 go 1.23.3
 
 require golang.org/x/sys v0.33.0
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,236 @@
+package watchmaker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The errors returned by Injector, which are checked by errors.Is. The error
+// returned wraps the cause too.
+var (
+	// ErrProcessGone is returned if the process exits or doesn't exist
+	ErrProcessGone = errors.New("process is gone")
+	// ErrPermission is returned if the process can't be traced or read, e.g.
+	// without CAP_SYS_PTRACE, or denied by yama ptrace_scope
+	ErrPermission = errors.New("permission denied")
+	// ErrSymbolNotFound is returned if a symbol to replace is not in vDSO
+	ErrSymbolNotFound = errors.New("cannot find symbol")
+	// ErrAlreadyInjected is returned by Inject if the process has been injected,
+	// use Update to change the fake time then
+	ErrAlreadyInjected = errors.New("process has been injected")
+	// ErrNotInjected is returned by Update if the process has not been injected
+	ErrNotInjected = errors.New("process has not been injected")
+)
+
+// SymbolError is returned if the fake image of Symbol fails to be injected or
+// updated, the images before Symbol are done and the images after it are skipped
+type SymbolError struct {
+	Symbol string
+	Err    error
+}
+
+func (e *SymbolError) Error() string {
+	return fmt.Sprintf("%v, symbol: %s", e.Err, e.Symbol)
+}
+
+func (e *SymbolError) Unwrap() error {
+	return e.Err
+}
+
+// Injector modifies the time of processes. It is the API for programs embedding
+// watchmaker, which is implemented by Skew, see NewInjector. The ctx is checked
+// between the phases of ptrace, and Inject removes the images injected already
+// if it fails or ctx is done.
+type Injector interface {
+	// Inject modifies the time of pid with cfg, it returns ErrAlreadyInjected if
+	// the process has been injected
+	Inject(ctx context.Context, pid int, cfg *Config) error
+	// Update changes the fake time of pid injected before to cfg
+	Update(ctx context.Context, pid int, cfg *Config) error
+	// Recover restores the real time of pid, it doesn't return error if the
+	// process has not been injected
+	Recover(ctx context.Context, pid int) error
+	// Status reads the fake images injected to pid without stopping it
+	Status(ctx context.Context, pid int) (*Status, error)
+}
+
+// Status is the state of a process read by Injector.Status
+type Status struct {
+	Pid    int
+	Images []ImageStatus
+	// Traced is true if the time syscalls of the process are traced by the
+	// injector, see BackendSyscall
+	Traced bool
+}
+
+// ImageStatus is the state of the fake image of a symbol
+type ImageStatus struct {
+	Symbol   string
+	Injected bool
+	// Address is the beginning of the injected image, which vDSO jumps to
+	Address uint64
+	// Variables are the current values of the extern variables of the image,
+	// e.g. TV_SEC_DELTA, the variables shorter than 8 bytes are zero extended
+	Variables map[string]uint64
+}
+
+// Injected returns true if any symbol of the process is replaced
+func (s *Status) Injected() bool {
+	for _, image := range s.Images {
+		if image.Injected {
+			return true
+		}
+	}
+	return false
+}
+
+// Delta returns TV_SEC_DELTA and TV_NSEC_DELTA of the image, which is the
+// offset added to the real time, or the instant if the time is frozen. ok is
+// false if the image is not injected or doesn't have the variables.
+func (s *ImageStatus) Delta() (sec int64, nsec int64, ok bool) {
+	sec64, okSec := s.Variables[externVarTvSecDelta]
+	nsec64, okNsec := s.Variables[externVarTvNsecDelta]
+	if !okSec && !okNsec {
+		return 0, 0, false
+	}
+	return int64(sec64), int64(nsec64), true
+}
+
+// ClockIDsMask returns CLOCK_IDS_MASK of the image, ok is false if the image
+// is not injected or doesn't have the variable, e.g. gettimeofday
+func (s *ImageStatus) ClockIDsMask() (mask uint64, ok bool) {
+	mask, ok = s.Variables[externVarClockIdsMask]
+	return mask, ok
+}
+
+// skewInjector implements Injector with Skew
+type skewInjector struct {
+	skew *Skew
+}
+
+// NewInjector returns the Injector of skew, the images, backend and stop mode of
+// skew are used, but its config is replaced by the config given to Inject and
+// Update. The skew must not be used directly at the same time.
+func NewInjector(skew *Skew) Injector {
+	return &skewInjector{skew: skew}
+}
+
+func (i *skewInjector) Inject(ctx context.Context, pid int, cfg *Config) error {
+	s := i.skew
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	status, err := s.status(pid)
+	if err != nil {
+		return classifyError(pid, err)
+	}
+	if status.Injected() || status.Traced {
+		return fmt.Errorf("%w, pid: %d", ErrAlreadyInjected, pid)
+	}
+
+	s.SkewConfig = cfg
+	err = s.inject(ctx, uint64(pid))
+	if err != nil {
+		// the images injected before the failure are removed, so the process is
+		// left unmodified
+		errIn := s.recover(context.Background(), uint64(pid))
+		if errIn != nil {
+			err = errors.Join(err, errIn)
+		}
+		return classifyError(pid, err)
+	}
+	return nil
+}
+
+func (i *skewInjector) Update(ctx context.Context, pid int, cfg *Config) error {
+	s := i.skew
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return classifyError(pid, s.update(ctx, uint64(pid), cfg))
+}
+
+func (i *skewInjector) Recover(ctx context.Context, pid int) error {
+	s := i.skew
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return classifyError(pid, s.recover(ctx, uint64(pid)))
+}
+
+func (i *skewInjector) Status(ctx context.Context, pid int) (*Status, error) {
+	s := i.skew
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	status, err := s.status(pid)
+	if err != nil {
+		return nil, classifyError(pid, err)
+	}
+	return status, nil
+}
+
+// status reads the images of the skew injected to pid, the locker must be held
+func (s *Skew) status(pid int) (*Status, error) {
+	_, traced := s.tracers[uint64(pid)]
+	status := &Status{Pid: pid, Traced: traced}
+	for _, image := range s.images {
+		imageStatus, err := image.status(pid)
+		if err != nil {
+			return nil, err
+		}
+		status.Images = append(status.Images, imageStatus)
+	}
+	return status, nil
+}
+
+// classifyError wraps err with the typed error of its cause, the errors of ctx
+// are returned as they are
+func classifyError(pid int, err error) error {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrProcessGone), errors.Is(err, ErrPermission),
+		errors.Is(err, ErrSymbolNotFound), errors.Is(err, ErrAlreadyInjected), errors.Is(err, ErrNotInjected):
+		return err
+	case errors.Is(err, unix.ESRCH) || !ProcessExists(pid):
+		return fmt.Errorf("%w, %w", err, ErrProcessGone)
+	case errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("%w, %w", err, ErrPermission)
+	}
+	return err
+}
+
+// ProcessExists returns false if the process has exited, zombies are
+// regarded as exited as they can't be traced any more
+func ProcessExists(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+
+	// according to procfs's man page, state follows the comm in parentheses
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return true
+	}
+	state := stat[i+2]
+	return state != 'Z' && state != 'X'
+}
@@ -0,0 +1,39 @@
+package watchmaker
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+// packageLogger is the logger of the package, which discards the logs unless
+// it is set by SetLogger
+var packageLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	SetLogger(nil)
+}
+
+// SetLogger sets the default logger of the package, which is used by the Skews
+// without their own logger, see Skew.SetLogger. The steps of injecting, updating
+// and recovering are logged at info level, and the details, e.g. the symbols of
+// vDSO and the mmap calls, at debug level. The logs are discarded if l is nil.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	packageLogger.Store(l)
+}
+
+// logger returns the logger set by SetLogger
+func logger() *slog.Logger {
+	return packageLogger.Load()
+}
+
+// loggerOr returns l, or the logger set by SetLogger if l is nil
+func loggerOr(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return logger()
+	}
+	return l
+}
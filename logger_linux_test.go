@@ -0,0 +1,46 @@
+package watchmaker
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestSkewLogger(t *testing.T) {
+	skew, err := GetSkew(NewConfig(0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew.log() != logger() {
+		t.Fatalf("skew logs to its own logger before SetLogger")
+	}
+
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	skew.SetLogger(l)
+	// the images set later log to the logger of the skew too
+	image := skew.images[len(skew.images)-1].clone()
+	image.logger = nil
+	err = skew.SetImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forked, err := skew.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Skew{skew, forked} {
+		if s.log() != l {
+			t.Errorf("skew doesn't log to the logger set by SetLogger")
+		}
+		for _, image := range s.images {
+			if image.log() != l {
+				t.Errorf("image of %s doesn't log to the logger of the skew", image.symbolName)
+			}
+		}
+	}
+
+	skew.SetLogger(nil)
+	if skew.log() != logger() || skew.images[0].log() != logger() {
+		t.Fatalf("skew doesn't log to the logger of the package after SetLogger(nil)")
+	}
+}
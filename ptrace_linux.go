@@ -2,14 +2,16 @@ package watchmaker
 
 import (
 	"bytes"
+	"context"
 	"debug/elf"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"runtime"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -23,6 +25,17 @@ const ptrSize = 4 << (^uintptr(0) >> 63)
 
 var threadRetryLimit = 10
 
+// stepOutLimit is the max number of instructions StepOutOf runs for a thread
+const stepOutLimit = 100000
+
+// callStackReserve is the stack left untouched below the stack pointer by Call,
+// which covers the 128 bytes red zone of x86_64
+const callStackReserve = 256
+
+// sigRTMin is the first real-time signal of the kernel, glibc reserves the first
+// ones for itself and reports a larger SIGRTMIN
+const sigRTMin = unix.Signal(32)
+
 // TracedProgram is a program traced by ptrace
 type TracedProgram struct {
 	pid     int
@@ -31,6 +44,33 @@ type TracedProgram struct {
 
 	backupRegs *unix.PtraceRegs
 	backupCode []byte
+
+	// allStopped is false if only the main thread is traced, see TraceMainThread
+	allStopped bool
+	// syscallAddr is a syscall instruction in vDSO, see prepareSyscall
+	syscallAddr uint64
+	// pendingSignals are the signals the main thread received while running a
+	// remote call or syscall, which are sent again by Detach, see resumeUntilTrap
+	pendingSignals []unix.Signal
+
+	// stoppedAt and allStoppedAt are when the main thread and all threads were
+	// stopped, phases are the time of every phase since stoppedAt
+	stoppedAt    time.Time
+	allStoppedAt time.Time
+	markedAt     time.Time
+	phases       []phaseTiming
+
+	// ctx is checked between the phases, see Err
+	ctx context.Context
+	// logger is nil unless the program is traced for a Skew with its own
+	// logger, see Skew.SetLogger
+	logger *slog.Logger
+}
+
+// phaseTiming is the time a phase of tracing took
+type phaseTiming struct {
+	name     string
+	duration time.Duration
 }
 
 // Pid return the pid of traced program
@@ -54,102 +94,199 @@ func waitPid(pid int) error {
 
 // Trace ptrace all threads of a process
 func Trace(pid int) (*TracedProgram, error) {
-	traceSuccess := false
+	return trace(pid, nil)
+}
 
-	tidMap := make(map[int]bool)
-	var attachedTids []int
-
-	// 定义统一清理逻辑：如果 traceSuccess 未被置为 true，则对所有已 attach 的线程进行 detach
-	defer func() {
-		if !traceSuccess {
-			for _, tid := range attachedTids {
-				if err := unix.PtraceDetach(tid); err != nil && !strings.Contains(err.Error(), "no such process") {
-					log.Println("detach failed", "tid", tid, "error", err)
-				}
-			}
+// trace is Trace, which logs to l, or to the logger of the package if l is nil
+func trace(pid int, l *slog.Logger) (*TracedProgram, error) {
+	program, err := traceMainThread(pid, l)
+	if err != nil {
+		return nil, err
+	}
+
+	err = program.StopAllThreads()
+	if err != nil {
+		errIn := program.Detach()
+		if errIn != nil {
+			program.log().Warn("fail to detach program", "pid", pid, "error", errIn)
+		}
+		return nil, err
+	}
+	return program, nil
+}
+
+// TraceMainThread ptrace only the main thread of a process, which runs the
+// remote syscalls. The other threads keep running until StopAllThreads, so the
+// code of the process must not be modified before it.
+func TraceMainThread(pid int) (*TracedProgram, error) {
+	return traceMainThread(pid, nil)
+}
+
+// traceMainThread is TraceMainThread, which logs to l, or to the logger of the
+// package if l is nil
+func traceMainThread(pid int, l *slog.Logger) (*TracedProgram, error) {
+	start := time.Now()
+	err := unix.PtraceSeize(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.PtraceInterrupt(pid)
+	if err == nil {
+		err = waitPid(pid)
+	}
+	if err != nil {
+		if errIn := unix.PtraceDetach(pid); errIn != nil && !strings.Contains(errIn.Error(), "no such process") {
+			loggerOr(l).Warn("detach failed", "tid", pid, "error", errIn)
 		}
-	}()
+		return nil, err
+	}
+	loggerOr(l).Debug("attach successfully", "tid", pid)
+
+	entries, err := ReadMaps(pid)
+	if err != nil {
+		if errIn := unix.PtraceDetach(pid); errIn != nil && !strings.Contains(errIn.Error(), "no such process") {
+			loggerOr(l).Warn("detach failed", "tid", pid, "error", errIn)
+		}
+		return nil, err
+	}
+
+	program := &TracedProgram{
+		pid:        pid,
+		tids:       []int{pid},
+		Entries:    entries,
+		backupRegs: &unix.PtraceRegs{},
+		backupCode: make([]byte, unixInstrSize),
+		stoppedAt:  start,
+		markedAt:   start,
+		logger:     l,
+	}
+	program.Mark("attach main thread")
+	return program, nil
+}
+
+// StopAllThreads ptrace the threads of the process not traced yet, until the
+// number of threads is stable. The threads attached are detached by Detach even
+// if it fails.
+func (p *TracedProgram) StopAllThreads() error {
+	if p.allStopped {
+		return nil
+	}
+	start := time.Now()
+
+	tidMap := make(map[int]bool)
+	for _, tid := range p.tids {
+		tidMap[tid] = true
+	}
 
 	// 循环遍历线程组，直到线程数稳定不再增加
 	for {
-		threads, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err := p.Err(); err != nil {
+			return err
+		}
+		threads, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", p.pid))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		subset := true
-		tids := make(map[int]bool)
 		for _, thread := range threads {
 			var tid64 int64
 			tid64, err = strconv.ParseInt(thread.Name(), 10, 32)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			tid := int(tid64)
 
 			if tidMap[tid] {
-				tids[tid] = true
 				continue
 			}
 			subset = false
 
 			err = unix.PtraceSeize(tid)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			err = unix.PtraceInterrupt(tid)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			// 成功 attach 后，记录 tid 用于后续统一 detach
-			attachedTids = append(attachedTids, tid)
+			p.tids = append(p.tids, tid)
+			tidMap[tid] = true
 
 			if err = waitPid(tid); err != nil {
-				return nil, err
+				return err
 			}
 
-			log.Println("attach successfully, process task id", tid)
-			tids[tid] = true
-			tidMap[tid] = true
+			p.log().Debug("attach successfully", "tid", tid)
 		}
 
 		if subset {
-			tidMap = tids
 			break
 		}
 	}
 
-	// 将 tidMap 中的 key 转换为 slice
-	var tidsList []int
-	for tid := range tidMap {
-		tidsList = append(tidsList, tid)
-	}
+	slices.Sort(p.tids)
+	p.allStopped = true
+	p.allStoppedAt = start
+	p.Mark("stop all threads")
+	return nil
+}
 
-	slices.Sort(tidsList)
+// log returns the logger of the program
+func (p *TracedProgram) log() *slog.Logger {
+	return loggerOr(p.logger)
+}
 
-	entries, err := ReadMaps(pid)
-	if err != nil {
-		return nil, err
-	}
+// SetContext sets the context checked between the phases of tracing
+func (p *TracedProgram) SetContext(ctx context.Context) {
+	p.ctx = ctx
+}
 
-	program := &TracedProgram{
-		pid:        pid,
-		tids:       tidsList,
-		Entries:    entries,
-		backupRegs: &unix.PtraceRegs{},
-		backupCode: make([]byte, unixInstrSize),
+// Err returns the error of the context if it is done, the caller gives up the
+// next phase then
+func (p *TracedProgram) Err() error {
+	if p.ctx == nil {
+		return nil
 	}
+	return p.ctx.Err()
+}
 
-	traceSuccess = true
+// Mark records the time passed since the last phase as phase, the phases are
+// logged by Detach with how long the process was paused
+func (p *TracedProgram) Mark(phase string) {
+	now := time.Now()
+	p.phases = append(p.phases, phaseTiming{name: phase, duration: now.Sub(p.markedAt)})
+	p.markedAt = now
+}
 
-	return program, nil
+// PtraceEvent returns the PTRACE_EVENT_* of a ptrace stop, or 0 if the stop is
+// not caused by a ptrace event. Unlike WaitStatus.TrapCause, group-stops of
+// PTRACE_SEIZE, which are reported with the stop signal, are recognized too.
+func PtraceEvent(status unix.WaitStatus) int {
+	return int(status>>16) & 0xff
 }
 
-// Detach detaches from all threads of the processes
+// Detach detaches from all threads of the processes, and logs how long they were
+// paused
 func (p *TracedProgram) Detach() error {
+	p.logPause()
+
+	// the signals are pending until the main thread runs again, which is after
+	// it is detached, so they are handled by the process instead of stopping it
+	for _, sig := range p.pendingSignals {
+		p.log().Debug("sending signal received while running remotely", "pid", p.pid, "signal", sig)
+		err := unix.Tgkill(p.pid, p.pid, sig)
+		if err != nil && !strings.Contains(err.Error(), "no such process") {
+			p.log().Warn("send signal failed", "pid", p.pid, "signal", sig, "error", err)
+		}
+	}
+	p.pendingSignals = nil
+
 	for _, tid := range p.tids {
-		log.Println("detaching, process task id", tid)
+		p.log().Debug("detaching", "tid", tid)
 		err := unix.PtraceDetach(tid)
 
 		if err != nil {
@@ -158,10 +295,174 @@ func (p *TracedProgram) Detach() error {
 			}
 		}
 	}
-	log.Println("Successfully detach and rerun process, pid", p.pid)
+	p.log().Debug("successfully detach and rerun process", "pid", p.pid)
 	return nil
 }
 
+// logPause logs the phases since the main thread was stopped
+func (p *TracedProgram) logPause() {
+	if p.stoppedAt.IsZero() {
+		return
+	}
+	p.Mark("finish")
+	var phases []string
+	for _, phase := range p.phases {
+		phases = append(phases, fmt.Sprintf("%s=%v", phase.name, phase.duration))
+	}
+	allPaused := time.Duration(0)
+	if p.allStopped {
+		allPaused = time.Since(p.allStoppedAt)
+	}
+	p.log().Info("process paused", "pid", p.pid, "main_thread", time.Since(p.stoppedAt), "threads", len(p.tids),
+		"all_threads", allPaused, "phases", strings.Join(phases, " "))
+}
+
+// prepareSyscall makes the main thread run the syscall instruction at the next
+// step. If every thread is stopped, the instruction is written at the current ip,
+// which is restored by Restore. Otherwise the other threads may run the code at
+// ip, so it is not modified, and ip is moved to a syscall instruction of vDSO.
+func (p *TracedProgram) prepareSyscall(regs *unix.PtraceRegs) error {
+	if p.allStopped {
+		instruction := make([]byte, unixInstrSize)
+		copy(instruction, syscallInstr)
+		ip := getIp(p.backupRegs)
+		_, err := unix.PtracePokeData(p.pid, ip, instruction)
+		if err != nil {
+			return fmt.Errorf("%T writing data %v to %x", err, instruction, ip)
+		}
+		return nil
+	}
+
+	if p.syscallAddr == 0 {
+		vdsoEntry, err := FindVDSOEntry(p)
+		if err != nil {
+			return err
+		}
+		vdso, err := p.GetLibBuffer(vdsoEntry)
+		if err != nil {
+			return fmt.Errorf("%v read vdso", err)
+		}
+		for offset := 0; offset+len(syscallInstr) <= len(*vdso); offset += syscallInstrAlign {
+			if bytes.Equal((*vdso)[offset:offset+len(syscallInstr)], syscallInstr) {
+				p.syscallAddr = vdsoEntry.StartAddress + uint64(offset)
+				break
+			}
+		}
+		if p.syscallAddr == 0 {
+			return fmt.Errorf("no syscall instruction in vdso, pid: %d", p.pid)
+		}
+	}
+	setIp(regs, p.syscallAddr)
+	return nil
+}
+
+// ReadIp returns the instruction pointer of a thread stopped by ptrace, the
+// registers are read in the way of the arch, see getRegs
+func ReadIp(tid int) (uint64, error) {
+	var regs unix.PtraceRegs
+	err := getRegs(tid, &regs)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(getIp(&regs)), nil
+}
+
+// StepOutOf single steps the threads stopped within [start, end) until they leave
+// it, e.g. the threads running a fake image which is going to be unmapped. The
+// code must not jump into the range again, which is true after the origin code
+// of vDSO is restored.
+func (p *TracedProgram) StepOutOf(start uint64, end uint64) error {
+	for _, tid := range p.tids {
+		for i := 0; ; i++ {
+			var regs unix.PtraceRegs
+			err := getRegs(tid, &regs)
+			if err != nil {
+				return err
+			}
+			ip := uint64(getIp(&regs))
+			if ip < start || ip >= end {
+				break
+			}
+			if i >= stepOutLimit {
+				return fmt.Errorf("thread %d is still in %#x-%#x after %d steps", tid, start, end, i)
+			}
+			if i == 0 {
+				p.log().Debug("stepping thread out of range", "tid", tid, "start", fmt.Sprintf("%#x", start), "end", fmt.Sprintf("%#x", end), "ip", fmt.Sprintf("%#x", ip))
+			}
+
+			err = unix.PtraceSingleStep(tid)
+			if err != nil {
+				return err
+			}
+			err = waitPid(tid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitCallReturn continues the main thread until it stops at the trapInstr at
+// returnAddr, see Call. The other threads are left as they are, so they keep
+// running unless StopAllThreads is called.
+func (p *TracedProgram) waitCallReturn(returnAddr uint64) error {
+	err := p.resumeUntilTrap(func(pid int) error {
+		return unix.PtraceCont(pid, 0)
+	})
+	if err != nil {
+		return err
+	}
+
+	var regs unix.PtraceRegs
+	err = getRegs(p.pid, &regs)
+	if err != nil {
+		return err
+	}
+	// the ip of x86 is after the trap instruction, and of arm64 is at it
+	ip := uint64(getIp(&regs))
+	if ip < returnAddr || ip > returnAddr+uint64(len(trapInstr)) {
+		return fmt.Errorf("process %d trapped at %#x, instead of returning to %#x", p.pid, ip, returnAddr)
+	}
+	return nil
+}
+
+// resumeUntilTrap resumes the main thread by resume until it stops by SIGTRAP,
+// e.g. at the end of a step or a call. A signal received meanwhile is suppressed,
+// as its handler would run on the registers set by watchmaker, and is sent again
+// by Detach.
+func (p *TracedProgram) resumeUntilTrap(resume func(pid int) error) error {
+	for {
+		err := resume(p.pid)
+		if err != nil {
+			return err
+		}
+
+		var status unix.WaitStatus
+		_, err = unix.Wait4(p.pid, &status, 0, nil)
+		if err != nil {
+			return err
+		}
+		if !status.Stopped() {
+			return fmt.Errorf("%w, process %d exits while running remotely, status: %#x", unix.ESRCH, p.pid, status)
+		}
+		if PtraceEvent(status) != 0 {
+			// a group-stop or PTRACE_INTERRUPT, no signal is delivered
+			continue
+		}
+		if status.StopSignal() == unix.SIGTRAP {
+			return nil
+		}
+		sig := status.StopSignal()
+		p.log().Debug("signal received while running remotely", "pid", p.pid, "signal", sig)
+		// standard signals are not queued by the kernel either, only the
+		// real-time signals may be pending more than once
+		if sig >= sigRTMin || !slices.Contains(p.pendingSignals, sig) {
+			p.pendingSignals = append(p.pendingSignals, sig)
+		}
+	}
+}
+
 // Protect will backup regs and rip into fields
 func (p *TracedProgram) Protect() error {
 	err := getRegs(p.pid, p.backupRegs)
@@ -177,12 +478,16 @@ func (p *TracedProgram) Protect() error {
 	return nil
 }
 
-// Restore will restore regs and rip from fields
+// Restore will restore regs and rip from fields. The code is restored only if
+// every thread is stopped, as it is not modified otherwise, see prepareSyscall.
 func (p *TracedProgram) Restore() error {
 	err := setRegs(p.pid, p.backupRegs)
 	if err != nil {
 		return err
 	}
+	if !p.allStopped {
+		return nil
+	}
 
 	_, err = unix.PtracePokeData(p.pid, getIp(p.backupRegs), p.backupCode)
 	if err != nil {
@@ -197,22 +502,18 @@ func (p *TracedProgram) Wait() error {
 	return waitPid(p.pid)
 }
 
-// Step moves one step forward
+// Step moves one step forward, a signal received before the step is sent again
+// by Detach, see resumeUntilTrap
 func (p *TracedProgram) Step() error {
-	err := unix.PtraceSingleStep(p.pid)
-	if err != nil {
-		return err
-	}
-
-	return p.Wait()
+	return p.resumeUntilTrap(unix.PtraceSingleStep)
 }
 
 // tryMmap attempts a single mmap syscall with error checking
 func (p *TracedProgram) tryMmap(addr, length, prot, flags, fd, offset uint64) (uint64, error) {
-	log.Printf("[MMAP DEBUG] attempting mmap(): len=%d, prot=%#x, flags=%#x, fd=%d, offset=%d, syscall_nr=%d", length, prot, flags, fd, offset, unix.SYS_MMAP)
+	p.log().Debug("mmap", "addr", fmt.Sprintf("%#x", addr), "length", length, "prot", prot, "flags", flags, "fd", fd, "offset", offset)
 
 	result, err := p.Syscall(unix.SYS_MMAP, addr, length, prot, flags, fd, offset)
-	log.Printf("[MMAP DEBUG] mmap syscall returned: result=%#x, err=%v\n", result, err)
+	p.log().Debug("mmap returned", "result", fmt.Sprintf("%#x", result), "error", err)
 	if err != nil {
 		return 0, err
 	}
@@ -229,39 +530,108 @@ func (p *TracedProgram) tryMmap(addr, length, prot, flags, fd, offset uint64) (u
 	return result, nil
 }
 
-// Mmap runs mmap syscall with fallback strategies for arm64
+// Mmap runs mmap syscall with fallback strategies for arm64. The mapping is
+// readable and writable, it is made executable by Mprotect after it is written.
 func (p *TracedProgram) Mmap(length uint64, fd uint64) (uint64, error) {
 	pageSize := uint64(os.Getpagesize())
 	alignedLength := (length + pageSize - 1) & ^(pageSize - 1) // round up to page boundary
 
-	log.Printf("[MMAP DEBUG] using aligned len=%d instead of original %d", alignedLength, length)
-
 	// Strategy 1: standard mmap call (size aligned)
-	result, err := p.tryMmap(0, alignedLength, unix.PROT_READ|unix.PROT_WRITE|unix.PROT_EXEC, unix.MAP_ANON|unix.MAP_PRIVATE, fd, 0)
+	result, err := p.tryMmap(0, alignedLength, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE, fd, 0)
 	if err == nil && result != 0 {
-		log.Printf("[MMAP DEBUG] strategy 1 (standard) succeeded: address=%#x", result)
 		return result, nil
 	}
-	log.Printf("[MMAP DEBUG] strategy 1 failed: %v, result=0x%x", err, result)
+	p.log().Debug("mmap strategy 1 failed", "result", fmt.Sprintf("%#x", result), "error", err)
 
 	// Strategy 2: larger allocation (2 pages minimum)
 	largerLength := alignedLength
 	if largerLength < 2*pageSize {
 		largerLength = 2 * pageSize
 	}
-	result, err = p.tryMmap(0, largerLength, unix.PROT_READ|unix.PROT_WRITE|unix.PROT_EXEC, unix.MAP_ANON|unix.MAP_PRIVATE, fd, 0)
+	result, err = p.tryMmap(0, largerLength, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE, fd, 0)
 	if err == nil && result != 0 {
-		log.Printf("[MMAP DEBUG] strategy 2 (larger allocation) succeeded: address=%#x, allocated=%d", result, largerLength)
 		return result, nil
 	}
-	log.Printf("[MMAP DEBUG] strategy 2 failed: %v, result=0x%x", err, result)
-
-	// TODO: Strategy 3: map without EXEC and enable it with MPROTECT?
+	p.log().Debug("mmap strategy 2 failed", "result", fmt.Sprintf("%#x", result), "error", err)
 
 	// all strategies failed
 	return 0, fmt.Errorf("all mmap strategies failed")
 }
 
+// MmapNear maps length bytes within maxDistance of addr, e.g. for a relative jump
+// from addr. The addresses around addr are given to mmap as hints one by one,
+// and the mapping is dropped if the kernel places it too far. The mapping is
+// readable and writable like Mmap.
+func (p *TracedProgram) MmapNear(length uint64, addr uint64, maxDistance uint64) (uint64, error) {
+	pageSize := uint64(os.Getpagesize())
+	alignedLength := (length + pageSize - 1) & ^(pageSize - 1)
+	if maxDistance <= alignedLength+pageSize {
+		return 0, fmt.Errorf("mmap %d bytes within %#x is impossible", length, maxDistance)
+	}
+	// the whole mapping must be in range, so there is a margin of its length
+	reach := maxDistance - alignedLength - pageSize
+
+	for _, step := range []uint64{1 << 20, 1 << 24, reach / 4, reach / 2} {
+		var hints []uint64
+		if addr > step {
+			hints = append(hints, (addr-step)&^(pageSize-1))
+		}
+		hints = append(hints, (addr+step)&^(pageSize-1))
+
+		for _, hint := range hints {
+			result, err := p.tryMmap(hint, alignedLength, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE, 0, 0)
+			if err != nil {
+				continue
+			}
+			if distance(result, addr) <= reach && distance(result+alignedLength, addr) <= reach {
+				p.log().Debug("mapped near", "address", fmt.Sprintf("%#x", result), "near", fmt.Sprintf("%#x", addr))
+				return result, nil
+			}
+			err = p.Munmap(result, alignedLength)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return 0, fmt.Errorf("no free address within %#x of %#x", maxDistance, addr)
+}
+
+func distance(a uint64, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Mprotect runs mprotect syscall, addr must be page aligned and length is rounded
+// up to pages by the kernel
+func (p *TracedProgram) Mprotect(addr uint64, length uint64, prot uint64) error {
+	result, err := p.Syscall(unix.SYS_MPROTECT, addr, length, prot)
+	if err != nil {
+		return err
+	}
+
+	if result != 0 {
+		return fmt.Errorf("mprotect returned error code: 0x%x", result)
+	}
+
+	return nil
+}
+
+// Munmap runs munmap syscall
+func (p *TracedProgram) Munmap(addr uint64, length uint64) error {
+	result, err := p.Syscall(unix.SYS_MUNMAP, addr, length)
+	if err != nil {
+		return err
+	}
+
+	if result != 0 {
+		return fmt.Errorf("munmap returned error code: 0x%x", result)
+	}
+
+	return nil
+}
+
 // ReadSlice reads from addr and return a slice
 func (p *TracedProgram) ReadSlice(addr uint64, size uint64) (*[]byte, error) {
 	buffer := make([]byte, size)
@@ -339,7 +709,16 @@ func alignBuffer(buffer []byte) []byte {
 func (p *TracedProgram) PtraceWriteSlice(addr uint64, buffer []byte) error {
 	wroteSize := 0
 
-	buffer = alignBuffer(buffer)
+	aligned := alignBuffer(buffer)
+	if len(aligned) > len(buffer) {
+		// the last word is read first, so the bytes after buffer are kept
+		_, err := unix.PtracePeekData(p.pid, uintptr(addr)+uintptr(len(aligned)-ptrSize), aligned[len(aligned)-ptrSize:])
+		if err != nil {
+			return fmt.Errorf("%T read addr %x failed", err, addr+uint64(len(aligned)-ptrSize))
+		}
+		copy(aligned, buffer)
+	}
+	buffer = aligned
 
 	for wroteSize+ptrSize <= len(buffer) {
 		_addr := uintptr(addr + uint64(wroteSize))
@@ -367,7 +746,8 @@ func (p *TracedProgram) GetLibBuffer(entry *Entry) (*[]byte, error) {
 	return p.ReadSlice(entry.StartAddress, size)
 }
 
-// MmapSlice mmaps a slice and return it's addr
+// MmapSlice mmaps a slice and return it's addr, the mapping is read only and
+// executable after the slice is written
 func (p *TracedProgram) MmapSlice(slice []byte) (*Entry, error) {
 	size := uint64(len(slice))
 
@@ -381,28 +761,59 @@ func (p *TracedProgram) MmapSlice(slice []byte) (*Entry, error) {
 		return nil, err
 	}
 
+	err = p.Mprotect(addr, size, unix.PROT_READ|unix.PROT_EXEC)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Entry{
 		StartAddress: addr,
 		EndAddress:   addr + size,
-		Privilege:    "rwxp",
+		Privilege:    "r-xp",
 		PaddingSize:  0,
 		Path:         "",
 	}, nil
 }
 
-// FindSymbolInEntry finds symbol in entry through parsing elf
+// SymbolLocation is the address and size of a symbol in an entry
+type SymbolLocation struct {
+	Name    string
+	Address uint64
+	Size    uint64
+}
+
+// symbolAliases returns the names symbolName is exported by in vDSO
+func symbolAliases(symbolName string) []string {
+	if aliases, ok := vdsoSymbolAliases[symbolName]; ok {
+		return aliases
+	}
+	return []string{symbolName}
+}
+
+// FindSymbolInEntry finds symbol in entry through parsing elf, the address of the
+// most preferred alias is returned
 func (p *TracedProgram) FindSymbolInEntry(symbolName string, entry *Entry) (uint64, uint64, error) {
-	log.Printf("[SYMBOL DEBUG] looking for symbol '%s'", symbolName)
+	locations, err := p.FindSymbolsInEntry(symbolName, entry)
+	if err != nil {
+		return 0, 0, err
+	}
+	return locations[0].Address, locations[0].Size, nil
+}
+
+// FindSymbolsInEntry finds every alias of symbol in entry through parsing elf,
+// see vdsoSymbolAliases. Aliases at the same address are returned once, in the
+// order of preference.
+func (p *TracedProgram) FindSymbolsInEntry(symbolName string, entry *Entry) ([]SymbolLocation, error) {
 
 	libBuffer, err := p.GetLibBuffer(entry)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	reader := bytes.NewReader(*libBuffer)
 	vdsoElf, err := elf.NewFile(reader)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	loadOffset := uint64(0)
@@ -410,7 +821,6 @@ func (p *TracedProgram) FindSymbolInEntry(symbolName string, entry *Entry) (uint
 	for _, prog := range vdsoElf.Progs {
 		if prog.Type == elf.PT_LOAD {
 			loadOffset = prog.Vaddr - prog.Off
-			log.Printf("[SYMBOL DEBUG] loadOffset=%#x", loadOffset)
 
 			// break here is enough for vdso
 			break
@@ -419,40 +829,46 @@ func (p *TracedProgram) FindSymbolInEntry(symbolName string, entry *Entry) (uint
 
 	symbols, err := vdsoElf.DynamicSymbols()
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
+	found := make(map[string]SymbolLocation)
+	var addresses []uint64
 	for _, symbol := range symbols {
 		offset := symbol.Value
 		location := entry.StartAddress + (offset - loadOffset)
-		log.Printf("[SYMBOL DEBUG] seeing '%s' with len=%d and offset=%#x at %#x", symbol.Name, symbol.Size, offset, location)
-
-		// try direct match first
-		if symbol.Name == symbolName {
-			log.Printf("[SYMBOL DEBUG] found '%s' at %#x", symbol.Name, location)
-			return location, symbol.Size, nil
+		found[symbol.Name] = SymbolLocation{Name: symbol.Name, Address: location, Size: symbol.Size}
+		addresses = append(addresses, location)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i] < addresses[j]
+	})
+
+	var locations []SymbolLocation
+	seen := make(map[uint64]bool)
+	for _, alias := range symbolAliases(symbolName) {
+		location, ok := found[alias]
+		if !ok || seen[location.Address] {
+			continue
 		}
-
-		// on arm64 try with "__kernel_" prefix
-		if runtime.GOARCH == "arm64" {
-			targetSymbol := "__kernel_" + symbolName
-			if symbol.Name == targetSymbol {
-				log.Printf("[SYMBOL DEBUG] found '%s' as '%s' at %#x", symbolName, symbol.Name, location)
-				return location, symbol.Size, nil
+		if location.Size == 0 {
+			// the size is unknown, it is safe to use the space before the next symbol
+			next := sort.Search(len(addresses), func(i int) bool {
+				return addresses[i] > location.Address
+			})
+			if next < len(addresses) {
+				location.Size = addresses[next] - location.Address
+			} else if location.Address < entry.EndAddress {
+				location.Size = entry.EndAddress - location.Address
 			}
 		}
-
-		/*
-			TODO: should we try "__vdso_" prefix as well? On amd64 you could get e.g. this:
-			2025/06/07 08:57:15 ptrace_linux.go:395: [SYMBOL DEBUG] looking for symbol 'gettimeofday'
-			2025/06/07 08:57:15 ptrace_linux.go:413: [SYMBOL DEBUG] loadOffset=0x0
-			2025/06/07 08:57:15 ptrace_linux.go:425: [SYMBOL DEBUG] found 'clock_gettime' with len=5 at 0xe40
-			2025/06/07 08:57:15 ptrace_linux.go:425: [SYMBOL DEBUG] found '__vdso_gettimeofday' with len=5 at 0xe00
-			2025/06/07 08:57:15 ptrace_linux.go:425: [SYMBOL DEBUG] found 'clock_getres' with len=117 at 0xe50
-			2025/06/07 08:57:15 ptrace_linux.go:425: [SYMBOL DEBUG] found '__vdso_clock_getres' with len=117 at 0xe50
-			2025/06/07 08:57:15 ptrace_linux.go:425: [SYMBOL DEBUG] found 'gettimeofday' with len=5 at 0xe00
-		*/
-	}
-	return 0, 0, fmt.Errorf("cannot find symbol '%s'", symbolName)
+		p.log().Debug("found symbol", "symbol", symbolName, "alias", alias, "address", fmt.Sprintf("%#x", location.Address))
+		seen[location.Address] = true
+		locations = append(locations, location)
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("%w '%s'", ErrSymbolNotFound, symbolName)
+	}
+	return locations, nil
 }
 
 // WriteUint64ToAddr writes uint64 to addr
@@ -2,7 +2,9 @@ package watchmaker
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 
 	"golang.org/x/sys/unix"
 )
@@ -11,10 +13,45 @@ var endian = binary.LittleEndian
 
 const unixInstrSize = 2
 
+// syscallInstr is `syscall`, which may be at any offset of vDSO
+var syscallInstr = []byte{0x0f, 0x05}
+
+const syscallInstrAlign = 1
+
+// trapInstr is `int3`, a function called by Call returns to it, see waitCallReturn
+var trapInstr = []byte{0xcc}
+
+// jumpInstrSize is the length of the code written by JumpToFakeFunc
+const jumpInstrSize = 16
+
+// relJumpInstrSize is the length of the code written by RelJumpToFakeFunc,
+// which jumps within relJumpRange
+const (
+	relJumpInstrSize = 5
+	relJumpRange     = 1 << 31
+)
+
+// vdsoSymbolAliases lists every name a function is exported by in vDSO, in the
+// order of preference. The weak aliases usually share the address with the
+// __vdso_ names, but all of them are patched in case they don't.
+var vdsoSymbolAliases = map[string][]string{
+	"clock_gettime": {"clock_gettime", "__vdso_clock_gettime"},
+	"gettimeofday":  {"gettimeofday", "__vdso_gettimeofday"},
+	"time":          {"time", "__vdso_time"},
+	// clock_getres is intentionally left unhooked by the built-in images, as the
+	// resolution is not affected by the offset. It is listed for the images
+	// given by --image only.
+	"clock_getres": {"clock_getres", "__vdso_clock_getres"},
+}
+
 func getIp(regs *unix.PtraceRegs) uintptr {
 	return uintptr(regs.Rip)
 }
 
+func setIp(regs *unix.PtraceRegs, ip uint64) {
+	regs.Rip = ip
+}
+
 func getRegs(pid int, regsout *unix.PtraceRegs) error {
 	err := unix.PtraceGetRegs(pid, regsout)
 	if err != nil {
@@ -70,20 +107,14 @@ func (p *TracedProgram) Syscall(number uint64, args ...uint64) (uint64, error) {
 			return 0, fmt.Errorf("too many arguments for a syscall")
 		}
 	}
-	err = setRegs(p.pid, &regs)
+	// the `syscall` instruction is run at the next step, see prepareSyscall
+	err = p.prepareSyscall(&regs)
 	if err != nil {
 		return 0, err
 	}
-
-	instruction := make([]byte, unixInstrSize)
-	ip := getIp(p.backupRegs)
-
-	// set the current instruction (the ip register points to) to the `syscall`
-	// instruction. In x86_64, the `syscall` instruction is 0x050f.
-	binary.LittleEndian.PutUint16(instruction, 0x050f)
-	_, err = unix.PtracePokeData(p.pid, ip, instruction)
+	err = setRegs(p.pid, &regs)
 	if err != nil {
-		return 0, fmt.Errorf("%T writing data %v to %x", err, instruction, ip)
+		return 0, err
 	}
 
 	// run one instruction, and stop
@@ -102,9 +133,77 @@ func (p *TracedProgram) Syscall(number uint64, args ...uint64) (uint64, error) {
 	return regs.Rax, p.Restore()
 }
 
+// Call runs the function at addr at main thread of process, which returns to
+// returnAddr, where trapInstr must be written. The arguments are passed in rdi,
+// rsi, rdx, rcx, r8 and r9 in order, and the return value is got from rax.
+func (p *TracedProgram) Call(addr uint64, returnAddr uint64, args ...uint64) (uint64, error) {
+	// save the original registers and the current instructions
+	err := p.Protect()
+	if err != nil {
+		return 0, err
+	}
+
+	var regs unix.PtraceRegs
+
+	err = getRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+	for index, arg := range args {
+		if index == 0 {
+			regs.Rdi = arg
+		} else if index == 1 {
+			regs.Rsi = arg
+		} else if index == 2 {
+			regs.Rdx = arg
+		} else if index == 3 {
+			regs.Rcx = arg
+		} else if index == 4 {
+			regs.R8 = arg
+		} else if index == 5 {
+			regs.R9 = arg
+		} else {
+			return 0, fmt.Errorf("too many arguments for a call")
+		}
+	}
+	// the return address is pushed below the red zone as by `call`, so rsp+8
+	// is aligned to 16 bytes at the entry of the function
+	sp := (regs.Rsp-callStackReserve)&^15 - 8
+	returnSlice := make([]byte, 8)
+	endian.PutUint64(returnSlice, returnAddr)
+	err = p.WriteSlice(sp, returnSlice)
+	if err != nil {
+		return 0, fmt.Errorf("%w write return address", err)
+	}
+	regs.Rsp = sp
+	// the number of vector registers of a variadic call
+	regs.Rax = 0
+	// the syscall interrupted by ptrace must not be restarted at addr, it is
+	// restarted after the registers are restored
+	regs.Orig_rax = math.MaxUint64
+	setIp(&regs, addr)
+	err = setRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.waitCallReturn(returnAddr)
+	if err != nil {
+		return 0, errors.Join(err, p.Restore())
+	}
+
+	err = getRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+
+	// restore the state saved at beginning.
+	return regs.Rax, p.Restore()
+}
+
 // JumpToFakeFunc writes jmp instruction to jump to fake function
 func (p *TracedProgram) JumpToFakeFunc(originAddr uint64, targetAddr uint64) error {
-	instructions := make([]byte, 16)
+	instructions := make([]byte, jumpInstrSize)
 
 	// mov rax, targetAddr;
 	// jmp rax ;
@@ -116,3 +215,33 @@ func (p *TracedProgram) JumpToFakeFunc(originAddr uint64, targetAddr uint64) err
 
 	return p.PtraceWriteSlice(originAddr, instructions)
 }
+
+// RelJumpToFakeFunc writes the shorter jmp rel32 instruction to jump to fake
+// function, targetAddr must be within relJumpRange of originAddr
+func (p *TracedProgram) RelJumpToFakeFunc(originAddr uint64, targetAddr uint64) error {
+	rel := int64(targetAddr) - int64(originAddr+relJumpInstrSize)
+	if rel < math.MinInt32 || rel > math.MaxInt32 {
+		return fmt.Errorf("%#x is out of the range of jmp rel32 at %#x", targetAddr, originAddr)
+	}
+	instructions := make([]byte, relJumpInstrSize)
+
+	// jmp rel32
+	instructions[0] = 0xe9
+	endian.PutUint32(instructions[1:], uint32(int32(rel)))
+
+	return p.PtraceWriteSlice(originAddr, instructions)
+}
+
+// ParseJumpToFakeFunc returns the target address if code at originAddr starts
+// with the instructions written by JumpToFakeFunc, or a relative jump which may
+// be written by RelJumpToFakeFunc or the origin code of vDSO.
+func ParseJumpToFakeFunc(code []byte, originAddr uint64) (uint64, bool, bool) {
+	if len(code) >= 12 && code[0] == 0x48 && code[1] == 0xb8 && code[10] == 0xff && code[11] == 0xe0 {
+		return endian.Uint64(code[2:10]), false, true
+	}
+	if len(code) >= relJumpInstrSize && code[0] == 0xe9 {
+		rel := int64(int32(endian.Uint32(code[1:5])))
+		return uint64(int64(originAddr+relJumpInstrSize) + rel), true, true
+	}
+	return 0, false, false
+}
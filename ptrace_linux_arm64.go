@@ -2,8 +2,8 @@ package watchmaker
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
 
 	"golang.org/x/sys/unix"
 )
@@ -12,6 +12,38 @@ var endian = binary.LittleEndian
 
 const unixInstrSize = 4
 
+// syscallInstr is `svc #0`, 0xd4000001 in little endian, which is aligned to
+// instructions in vDSO
+var syscallInstr = []byte{0x01, 0x00, 0x00, 0xd4}
+
+const syscallInstrAlign = 4
+
+// trapInstr is `brk #0`, 0xd4200000 in little endian, a function called by Call
+// returns to it, see waitCallReturn
+var trapInstr = []byte{0x00, 0x00, 0x20, 0xd4}
+
+// jumpInstrSize is the length of the code written by JumpToFakeFunc
+const jumpInstrSize = 16
+
+// relJumpInstrSize is the length of the code written by RelJumpToFakeFunc,
+// which jumps within relJumpRange
+const (
+	relJumpInstrSize = 4
+	relJumpRange     = 1 << 27
+)
+
+// vdsoSymbolAliases lists every name a function is exported by in vDSO, in the
+// order of preference. There is no time in arm64 vDSO, as there is no time
+// syscall either, libc implements time() by clock_gettime(CLOCK_REALTIME_COARSE).
+var vdsoSymbolAliases = map[string][]string{
+	"clock_gettime": {"__kernel_clock_gettime", "clock_gettime"},
+	"gettimeofday":  {"__kernel_gettimeofday", "gettimeofday"},
+	// clock_getres is intentionally left unhooked by the built-in images, as the
+	// resolution is not affected by the offset. It is listed for the images
+	// given by --image only.
+	"clock_getres": {"__kernel_clock_getres", "clock_getres"},
+}
+
 // see kernel source /include/uapi/linux/elf.h
 const nrPRStatus = 1
 
@@ -19,6 +51,10 @@ func getIp(regs *unix.PtraceRegs) uintptr {
 	return uintptr(regs.Pc)
 }
 
+func setIp(regs *unix.PtraceRegs, ip uint64) {
+	regs.Pc = ip
+}
+
 func getRegs(pid int, regsout *unix.PtraceRegs) error {
 	err := unix.PtraceGetRegSetArm64(pid, nrPRStatus, (*unix.PtraceRegsArm64)(regsout))
 	if err != nil {
@@ -60,24 +96,18 @@ func (p *TracedProgram) Syscall(number uint64, args ...uint64) (uint64, error) {
 			regs.Regs[index] = arg
 		}
 	}
-	err = setRegs(p.pid, &regs)
+	// most aarch64 devices are little endian, `svc #0` is run at the next
+	// step, see prepareSyscall
+	err = p.prepareSyscall(&regs)
 	if err != nil {
 		return 0, err
 	}
-
-	instruction := make([]byte, unixInstrSize)
-	ip := getIp(p.backupRegs)
-
-	// most aarch64 devices are little endian
-	// 0xd4000001 is `svc #0` to call the system call
-	endian.PutUint32(instruction, 0xd4000001)
-	_, err = unix.PtracePokeData(p.pid, ip, instruction)
+	err = setRegs(p.pid, &regs)
 	if err != nil {
-		return 0, fmt.Errorf("%T writing data %v to %x", err, instruction, ip)
+		return 0, err
 	}
 
 	// run one instruction, and stop
-	log.Printf("[SYSCALL DEBUG] running %x from %#x", instruction, ip)
 	err = p.Step()
 	if err != nil {
 		return 0, err
@@ -88,7 +118,6 @@ func (p *TracedProgram) Syscall(number uint64, args ...uint64) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	log.Printf("[SYSCALL DEBUG] regs: %v", regs)
 
 	// TODO: why "strategy 1" mmap() is failing on arm64 with 0 returned from this proc?
 	// https://stackoverflow.com/questions/37167141/linux-syscalls-and-errno
@@ -96,9 +125,54 @@ func (p *TracedProgram) Syscall(number uint64, args ...uint64) (uint64, error) {
 	return regs.Regs[0], p.Restore()
 }
 
+// Call runs the function at addr at main thread of process, which returns to
+// returnAddr, where trapInstr must be written. The arguments are passed in x0 to
+// x7 in order, and the return value is got from x0.
+func (p *TracedProgram) Call(addr uint64, returnAddr uint64, args ...uint64) (uint64, error) {
+	// save the original registers and the current instructions
+	err := p.Protect()
+	if err != nil {
+		return 0, err
+	}
+
+	var regs unix.PtraceRegs
+
+	err = getRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+	if len(args) > 8 {
+		return 0, fmt.Errorf("too many arguments for a call")
+	}
+	for index, arg := range args {
+		regs.Regs[index] = arg
+	}
+	// the function returns to the link register x30, sp must be aligned to 16 bytes
+	regs.Regs[30] = returnAddr
+	regs.Sp = (regs.Sp - callStackReserve) &^ 15
+	setIp(&regs, addr)
+	err = setRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+
+	err = p.waitCallReturn(returnAddr)
+	if err != nil {
+		return 0, errors.Join(err, p.Restore())
+	}
+
+	err = getRegs(p.pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+
+	// restore the state saved at beginning.
+	return regs.Regs[0], p.Restore()
+}
+
 // JumpToFakeFunc writes jmp instruction to jump to fake function
 func (p *TracedProgram) JumpToFakeFunc(originAddr uint64, targetAddr uint64) error {
-	instructions := make([]byte, 16)
+	instructions := make([]byte, jumpInstrSize)
 
 	// LDR x9, #8
 	// BR x9
@@ -110,3 +184,33 @@ func (p *TracedProgram) JumpToFakeFunc(originAddr uint64, targetAddr uint64) err
 
 	return p.PtraceWriteSlice(originAddr, instructions)
 }
+
+// RelJumpToFakeFunc writes the shorter b instruction to jump to fake function,
+// targetAddr must be within relJumpRange of originAddr
+func (p *TracedProgram) RelJumpToFakeFunc(originAddr uint64, targetAddr uint64) error {
+	rel := int64(targetAddr) - int64(originAddr)
+	if rel%4 != 0 || rel < -relJumpRange || rel >= relJumpRange {
+		return fmt.Errorf("%#x is out of the range of b at %#x", targetAddr, originAddr)
+	}
+	instructions := make([]byte, relJumpInstrSize)
+
+	// B targetAddr
+	endian.PutUint32(instructions, 0x14000000|uint32(rel>>2)&0x03ffffff)
+
+	return p.PtraceWriteSlice(originAddr, instructions)
+}
+
+// ParseJumpToFakeFunc returns the target address if code at originAddr starts
+// with the instructions written by JumpToFakeFunc, or a relative jump which may
+// be written by RelJumpToFakeFunc or the origin code of vDSO.
+func ParseJumpToFakeFunc(code []byte, originAddr uint64) (uint64, bool, bool) {
+	if len(code) >= jumpInstrSize && endian.Uint32(code[0:]) == 0x58000049 && endian.Uint32(code[4:]) == 0xD61F0120 {
+		return endian.Uint64(code[8:]), false, true
+	}
+	if len(code) >= relJumpInstrSize && endian.Uint32(code)&0xfc000000 == 0x14000000 {
+		// sign extend imm26
+		rel := int64(int32(endian.Uint32(code)<<6)>>6) << 2
+		return uint64(int64(originAddr) + rel), true, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,384 @@
+package watchmaker
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backend is the way Skew modifies the time of a process
+type Backend string
+
+const (
+	// BackendVDSO replaces the time functions in vDSO with fake images
+	BackendVDSO Backend = "vdso"
+	// BackendSyscall traces the process and rewrites the results of time
+	// syscalls, so programs bypassing vDSO are modified too. The vDSO functions
+	// are replaced with fake images which don't modify the time, so they issue
+	// the syscalls instead. The process is modified only while watchmaker is
+	// running, as the tracer is a thread of watchmaker.
+	BackendSyscall Backend = "syscall"
+)
+
+// ParseBackend returns the backend named s
+func ParseBackend(s string) (Backend, error) {
+	switch Backend(s) {
+	case BackendVDSO, BackendSyscall:
+		return Backend(s), nil
+	}
+	return "", fmt.Errorf("unknown backend %s, expected %s or %s", s, BackendVDSO, BackendSyscall)
+}
+
+// syscallStopSignal is the stop signal of syscall-stops with PTRACE_O_TRACESYSGOOD
+const syscallStopSignal = unix.SIGTRAP | 0x80
+
+// tracedThread is the state of a thread traced by syscallTracer
+type tracedThread struct {
+	// inSyscall is true between syscall-enter-stop and syscall-exit-stop
+	inSyscall bool
+	// nr and args are saved at syscall-enter-stop, as the registers of
+	// arguments may be overwritten by the return value
+	nr   uint64
+	args [2]uint64
+}
+
+// syscallTracer traces all threads of a process and rewrites the results of
+// clock_gettime, gettimeofday and time syscalls with config.
+type syscallTracer struct {
+	pid int
+
+	mu     sync.Mutex
+	config *Config
+
+	stopping atomic.Bool
+	done     chan struct{}
+	// logger is the logger of the skew, see Skew.SetLogger
+	logger *slog.Logger
+}
+
+// startSyscallTracer attaches to all threads of the process in a new locked
+// thread, as all ptrace requests must come from the tracer thread. It returns
+// after the process is attached. The tracer logs to l, or to the logger of the
+// package if l is nil.
+func startSyscallTracer(pid int, c *Config, l *slog.Logger) (*syscallTracer, error) {
+	t := &syscallTracer{
+		pid:    pid,
+		config: c,
+		done:   make(chan struct{}),
+		logger: l,
+	}
+	ready := make(chan error, 1)
+	go t.run(ready)
+	err := <-ready
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// log returns the logger of the tracer
+func (t *syscallTracer) log() *slog.Logger {
+	return loggerOr(t.logger)
+}
+
+// setConfig replaces the config used by the following syscalls
+func (t *syscallTracer) setConfig(c *Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config = c
+}
+
+func (t *syscallTracer) getConfig() *Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config
+}
+
+// running returns false if the tracer has exited, e.g. the process has exited
+func (t *syscallTracer) running() bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop detaches from the process and waits until the tracer exits. The tracer
+// may be waiting for a stop of the process, so SIGCONT is sent to wake it up,
+// which doesn't change a running process.
+func (t *syscallTracer) stop() {
+	t.stopping.Store(true)
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	err := unix.Kill(t.pid, unix.SIGCONT)
+	if err != nil {
+		t.log().Warn("wake up tracer", "pid", t.pid, "error", err)
+	}
+	<-t.done
+}
+
+func (t *syscallTracer) run(ready chan<- error) {
+	// the thread is not unlocked, it exits with the goroutine, so no other
+	// goroutine runs on the tracer thread
+	runtime.LockOSThread()
+	defer close(t.done)
+
+	threads, err := t.attach()
+	ready <- err
+	if err != nil {
+		return
+	}
+	t.loop(threads)
+}
+
+// attach seizes all threads of the process, new threads are traced automatically
+// by PTRACE_O_TRACECLONE.
+func (t *syscallTracer) attach() (map[int]*tracedThread, error) {
+	threads := make(map[int]*tracedThread)
+	options := uintptr(unix.PTRACE_O_TRACESYSGOOD | unix.PTRACE_O_TRACECLONE)
+	// loop until no new thread is found, as untraced threads may create threads
+	for {
+		tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", t.pid))
+		if err != nil {
+			t.detachAll(threads)
+			return nil, err
+		}
+		added := false
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+			if _, ok := threads[tid]; ok {
+				continue
+			}
+			_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(tid), 0, options, 0, 0)
+			if errno == unix.ESRCH {
+				continue
+			}
+			if errno != 0 {
+				t.detachAll(threads)
+				return nil, fmt.Errorf("%v ptrace on target process, tid: %d", errno, tid)
+			}
+			threads[tid] = &tracedThread{}
+			added = true
+			t.log().Debug("attach successfully", "tid", tid)
+		}
+		if !added {
+			break
+		}
+	}
+	if len(threads) == 0 {
+		return nil, fmt.Errorf("no thread is traced, pid: %d", t.pid)
+	}
+
+	// start tracing syscalls, the threads are running after PTRACE_SEIZE, so they
+	// are interrupted first
+	for tid := range threads {
+		_ = unix.PtraceInterrupt(tid)
+	}
+	return threads, nil
+}
+
+// detachAll detaches from the threads which are not stopped
+func (t *syscallTracer) detachAll(threads map[int]*tracedThread) {
+	for tid := range threads {
+		_ = unix.PtraceInterrupt(tid)
+		var status unix.WaitStatus
+		_, err := unix.Wait4(tid, &status, unix.WALL, nil)
+		if err == nil && status.Stopped() {
+			_ = unix.PtraceDetach(tid)
+		}
+	}
+}
+
+// loop handles the stops of the traced threads until all threads exit or the
+// tracer is stopping
+func (t *syscallTracer) loop(threads map[int]*tracedThread) {
+	interrupted := false
+	for len(threads) > 0 {
+		var status unix.WaitStatus
+		// __WNOTHREAD keeps tracers of other processes from taking the stops
+		tid, err := unix.Wait4(-1, &status, unix.WALL|unix.WNOTHREAD, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			t.log().Warn("wait for traced process", "pid", t.pid, "error", err)
+			return
+		}
+		th, ok := threads[tid]
+		if !ok {
+			// a new thread traced by PTRACE_O_TRACECLONE
+			th = &tracedThread{}
+			threads[tid] = th
+		}
+		if status.Exited() || status.Signaled() {
+			delete(threads, tid)
+			continue
+		}
+		if !status.Stopped() {
+			continue
+		}
+
+		sig := 0
+		groupStop := false
+		switch {
+		case status.StopSignal() == syscallStopSignal:
+			t.handleSyscall(tid, th)
+		case PtraceEvent(status) == unix.PTRACE_EVENT_STOP:
+			// PTRACE_EVENT_STOP is reported with SIGTRAP for PTRACE_INTERRUPT
+			// and new threads, otherwise it is a group-stop like SIGTSTP
+			groupStop = status.StopSignal() != unix.SIGTRAP
+		case PtraceEvent(status) > 0:
+			// other ptrace events like PTRACE_EVENT_CLONE
+		default:
+			// signal-delivery-stop, the signal is delivered when continued
+			sig = int(status.StopSignal())
+		}
+
+		if t.stopping.Load() {
+			// a thread detached at syscall-enter-stop gets the real time from
+			// the syscall, which is expected as the process is recovering
+			err = ptraceWithData(unix.PTRACE_DETACH, tid, uintptr(sig))
+			if err != nil && err != unix.ESRCH {
+				t.log().Warn("fail to detach thread", "tid", tid, "error", err)
+			}
+			delete(threads, tid)
+			if !interrupted {
+				interrupted = true
+				for other := range threads {
+					_ = unix.PtraceInterrupt(other)
+				}
+			}
+			continue
+		}
+
+		if groupStop {
+			// keep the thread stopped until SIGCONT
+			err = ptraceWithData(unix.PTRACE_LISTEN, tid, 0)
+		} else {
+			err = ptraceWithData(unix.PTRACE_SYSCALL, tid, uintptr(sig))
+		}
+		if err != nil && err != unix.ESRCH {
+			t.log().Warn("fail to continue thread", "tid", tid, "error", err)
+		}
+	}
+	t.log().Info("stop tracing syscalls", "pid", t.pid)
+}
+
+// handleSyscall saves the syscall at syscall-enter-stop, and rewrites its
+// result at syscall-exit-stop
+func (t *syscallTracer) handleSyscall(tid int, th *tracedThread) {
+	var regs unix.PtraceRegs
+	err := getRegs(tid, &regs)
+	if err != nil {
+		t.log().Warn("get registers of traced thread", "tid", tid, "error", err)
+		return
+	}
+	if !th.inSyscall {
+		th.inSyscall = true
+		th.nr = syscallNumber(&regs)
+		th.args = syscallArgs(&regs)
+		return
+	}
+	th.inSyscall = false
+
+	err = t.rewrite(tid, th, &regs)
+	if err != nil {
+		t.log().Warn("rewrite syscall", "nr", th.nr, "tid", tid, "error", err)
+	}
+}
+
+// splitNanoseconds splits ns since the epoch into the seconds and the rest in
+// unit, like timespec and timeval. The rest is never negative, so a time before
+// the epoch has the seconds rounded down, e.g. -1.5s is -2s and 0.5s.
+func splitNanoseconds(ns int64, unit time.Duration) (int64, int64) {
+	sec, rest := ns/int64(time.Second), ns%int64(time.Second)
+	if rest < 0 {
+		sec--
+		rest += int64(time.Second)
+	}
+	return sec, rest / int64(unit)
+}
+
+// rewrite modifies the result of the time syscall in the same way as the fake images
+func (t *syscallTracer) rewrite(tid int, th *tracedThread, regs *unix.PtraceRegs) error {
+	ret := syscallReturn(regs)
+	program := &TracedProgram{pid: tid, logger: t.logger}
+	c := t.getConfig()
+
+	switch th.nr {
+	case unix.SYS_CLOCK_GETTIME:
+		clkID, tp := th.args[0], th.args[1]
+		if ret != 0 || tp == 0 || clkID >= 64 || c.clockIDsMask&(1<<clkID) == 0 {
+			return nil
+		}
+		data, err := program.ReadSlice(tp, 16)
+		if err != nil {
+			return err
+		}
+		real := int64(endian.Uint64((*data)[0:8]))*int64(time.Second) + int64(endian.Uint64((*data)[8:16]))
+		// the rate applies to CLOCK_REALTIME
+		realNow := real
+		if clkID != unix.CLOCK_REALTIME && clkID != unix.CLOCK_REALTIME_COARSE {
+			realNow = time.Now().UnixNano()
+		}
+		sec, nsec := splitNanoseconds(c.fakeNanoseconds(real, realNow), time.Nanosecond)
+		endian.PutUint64((*data)[0:8], uint64(sec))
+		endian.PutUint64((*data)[8:16], uint64(nsec))
+		return program.WriteSlice(tp, *data)
+	case unix.SYS_GETTIMEOFDAY:
+		tv := th.args[0]
+		if ret != 0 || tv == 0 {
+			return nil
+		}
+		data, err := program.ReadSlice(tv, 16)
+		if err != nil {
+			return err
+		}
+		real := int64(endian.Uint64((*data)[0:8]))*int64(time.Second) + int64(endian.Uint64((*data)[8:16]))*int64(time.Microsecond)
+		sec, usec := splitNanoseconds(c.fakeNanoseconds(real, real), time.Microsecond)
+		endian.PutUint64((*data)[0:8], uint64(sec))
+		endian.PutUint64((*data)[8:16], uint64(usec))
+		return program.WriteSlice(tv, *data)
+	case sysTime:
+		if ret < 0 {
+			return nil
+		}
+		// time has no sub-second precision, so the real time of watchmaker is
+		// used like the fake image using gettimeofday
+		realNow := time.Now().UnixNano()
+		fake, _ := splitNanoseconds(c.fakeNanoseconds(realNow, realNow), time.Second)
+		setSyscallReturn(regs, fake)
+		err := setRegs(tid, regs)
+		if err != nil {
+			return err
+		}
+		if tloc := th.args[0]; tloc != 0 {
+			return program.WriteUint64ToAddr(tloc, uint64(fake))
+		}
+	}
+	return nil
+}
+
+// ptraceWithData sends a ptrace request with data, which is the signal to deliver
+// for most requests
+func ptraceWithData(request int, tid int, data uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(tid), 0, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
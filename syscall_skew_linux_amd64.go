@@ -0,0 +1,22 @@
+package watchmaker
+
+import "golang.org/x/sys/unix"
+
+// sysTime is the number of time syscall
+const sysTime = unix.SYS_TIME
+
+func syscallNumber(regs *unix.PtraceRegs) uint64 {
+	return regs.Orig_rax
+}
+
+func syscallArgs(regs *unix.PtraceRegs) [2]uint64 {
+	return [2]uint64{regs.Rdi, regs.Rsi}
+}
+
+func syscallReturn(regs *unix.PtraceRegs) int64 {
+	return int64(regs.Rax)
+}
+
+func setSyscallReturn(regs *unix.PtraceRegs, ret int64) {
+	regs.Rax = uint64(ret)
+}
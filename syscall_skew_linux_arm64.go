@@ -0,0 +1,23 @@
+package watchmaker
+
+import "golang.org/x/sys/unix"
+
+// sysTime is the number of time syscall, there is no time syscall on arm64
+const sysTime = ^uint64(0)
+
+func syscallNumber(regs *unix.PtraceRegs) uint64 {
+	// the syscall number is passed in x8
+	return regs.Regs[8]
+}
+
+func syscallArgs(regs *unix.PtraceRegs) [2]uint64 {
+	return [2]uint64{regs.Regs[0], regs.Regs[1]}
+}
+
+func syscallReturn(regs *unix.PtraceRegs) int64 {
+	return int64(regs.Regs[0])
+}
+
+func setSyscallReturn(regs *unix.PtraceRegs, ret int64) {
+	regs.Regs[0] = uint64(ret)
+}
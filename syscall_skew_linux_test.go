@@ -0,0 +1,67 @@
+package watchmaker
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestInjectedBySyscallTracer checks a process traced by BackendSyscall is
+// injected even after exec, when its new vDSO is not replaced
+func TestInjectedBySyscallTracer(t *testing.T) {
+	skew, err := GetSkewWithBackend(NewConfig(0, 0, 0), BackendSyscall)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the vDSO of the test is never replaced, like a process after exec
+	pid := uint64(os.Getpid())
+	tracer := &syscallTracer{pid: int(pid), done: make(chan struct{})}
+	skew.tracers[pid] = tracer
+
+	injected, err := skew.Injected(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !injected {
+		t.Fatalf("process traced by the syscall tracer is not injected")
+	}
+
+	close(tracer.done)
+	injected, err = skew.Injected(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if injected {
+		t.Fatalf("process is injected after the tracer exits")
+	}
+}
+
+// TestSplitNegativeFakeTime checks the sub-second part of a fake time before the
+// epoch, given by a negative offset, is in the range of timespec and timeval
+func TestSplitNegativeFakeTime(t *testing.T) {
+	// 1.5s after the epoch, offset by -3s
+	real := int64(1500 * time.Millisecond)
+	c := NewConfig(-3, 0, 1)
+	fake := c.fakeNanoseconds(real, real)
+
+	cases := []struct {
+		unit time.Duration
+		sec  int64
+		rest int64
+	}{
+		{time.Nanosecond, -2, 500000000},
+		{time.Microsecond, -2, 500000},
+		{time.Second, -2, 0},
+	}
+	for _, tc := range cases {
+		sec, rest := splitNanoseconds(fake, tc.unit)
+		if sec != tc.sec || rest != tc.rest {
+			t.Errorf("split %d in %v: got %d, %d, want %d, %d", fake, tc.unit, sec, rest, tc.sec, tc.rest)
+		}
+	}
+
+	sec, rest := splitNanoseconds(-int64(time.Second), time.Nanosecond)
+	if sec != -1 || rest != 0 {
+		t.Errorf("split a whole second before the epoch: got %d, %d", sec, rest)
+	}
+}
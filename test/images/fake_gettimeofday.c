@@ -0,0 +1,27 @@
+// fake_gettimeofday is a sample hook of --image, which exercises the
+// relocations against .rodata, a static function and extern variables of
+// different sizes. gettimeofday returns TV_SEC_DELTA + 7 + table[...].
+
+#include <sys/time.h>
+#include <inttypes.h>
+
+extern int64_t TV_SEC_DELTA;
+extern int32_t FAKE_MODE;
+
+static const int64_t table[4] = {0, 1000, 2000, 3000};
+
+static int64_t add(int64_t a, int64_t b);
+
+int fake_gettimeofday(struct timeval *tv, void *tz)
+{
+    if (tv) {
+        tv->tv_sec = add(TV_SEC_DELTA, 7);
+        tv->tv_usec = 0;
+    }
+    return 0;
+}
+
+static int64_t __attribute__((noinline)) add(int64_t a, int64_t b)
+{
+    return a + b + table[(FAKE_MODE + 1) & 3];
+}
@@ -0,0 +1,27 @@
+#!/bin/sh -eux
+
+if [ "${GITHUB_RUN_ID}" -gt 0 ]; then
+    _SUDO="sudo"
+else
+    _SUDO=
+fi
+
+TESTROOT="$1"
+OUTPUT=$(mktemp "/tmp/test-exec.XXXXXX")
+
+cleanup() {
+    rm -f "${OUTPUT}"
+}
+
+trap "cleanup" EXIT
+
+_GOARCH=$(go env GOARCH)
+
+# the wrapper shell forks and then executes date, as date is not the last
+# command, so date is modified only if the forked children are followed
+${_SUDO} "${TESTROOT}/../bin/watchmaker_linux_${_GOARCH}" run --faketime '2021-01-01' --follow-exec -- \
+    sh -c 'date +%Y; true' >"${OUTPUT}"
+
+cat "${OUTPUT}"
+
+grep -l -- "2021" "${OUTPUT}"
@@ -0,0 +1,40 @@
+#!/bin/sh -eux
+
+if [ "${GITHUB_RUN_ID}" -gt 0 ]; then
+    _SUDO="sudo"
+else
+    _SUDO=
+fi
+
+IMAGE="$1"
+TESTROOT="$2"
+OUTPUT=$(mktemp "/tmp/test-image.XXXXXX")
+
+cleanup() {
+    rm -f "${OUTPUT}"
+}
+
+trap "cleanup" EXIT
+
+_GOARCH=$(go env GOARCH)
+
+if [ ! -f "${TESTROOT}/build/images/${IMAGE}_${_GOARCH}.o" ]; then
+    echo "${TESTROOT}/build/images/${IMAGE}_${_GOARCH}.o not found" >&2
+    exit 1
+fi
+
+"${TESTROOT}/test_gettimeofday" >"${OUTPUT}" 2>&1 &
+
+pid=$!
+
+sleep 1
+
+# the sample hook returns the frozen instant plus less than an hour
+${_SUDO} "${TESTROOT}/../bin/watchmaker_linux_${_GOARCH}" --freeze '2021-01-01 00:00:00' --pid "$pid" \
+    --image "gettimeofday=${TESTROOT}/build/images/${IMAGE}_${_GOARCH}.o"
+
+wait
+
+cat "${OUTPUT}"
+
+grep -l -- "2021" "${OUTPUT}"
@@ -1,10 +1,14 @@
 package watchmaker
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"runtime"
+	"log/slog"
+	"math"
+	"math/big"
 	"sync"
+	"time"
 )
 
 const _time = "time"
@@ -12,11 +16,25 @@ const _time = "time"
 // clockGettime is the target function would be replaced
 const clockGettime = "clock_gettime"
 
-// These three consts corresponding to the three extern variables in the fake_clock_gettime.c
+// These consts corresponding to the extern variables in the fake_clock_gettime.c
 const (
 	externVarClockIdsMask = "CLOCK_IDS_MASK"
 	externVarTvSecDelta   = "TV_SEC_DELTA"
 	externVarTvNsecDelta  = "TV_NSEC_DELTA"
+	externVarRateAnchor   = "RATE_ANCHOR"
+	externVarRate         = "RATE"
+	externVarFakeMode     = "FAKE_MODE"
+)
+
+// rateOne is the fixed-point RATE of real speed, RATE has 32 fractional bits
+const rateOne = 1 << 32
+
+// These consts are the values of FAKE_MODE
+const (
+	// modeOffset adds the delta to the real time
+	modeOffset = 0
+	// modeFreeze returns the delta as a fixed instant
+	modeFreeze = 1
 )
 
 // getTimeOfDay is the target function would be replaced
@@ -31,6 +49,12 @@ type Config struct {
 	deltaSeconds     int64
 	deltaNanoSeconds int64
 	clockIDsMask     uint64
+	// rate is the fixed-point speed of the fake time, see rateOne
+	rate uint64
+	// rateAnchor is the real time in nanoseconds since when the rate applies
+	rateAnchor int64
+	// mode is modeOffset or modeFreeze
+	mode uint64
 }
 
 func NewConfig(deltaSeconds int64, deltaNanoSeconds int64, clockIDsMask uint64) *Config {
@@ -38,7 +62,34 @@ func NewConfig(deltaSeconds int64, deltaNanoSeconds int64, clockIDsMask uint64)
 		deltaSeconds:     deltaSeconds,
 		deltaNanoSeconds: deltaNanoSeconds,
 		clockIDsMask:     clockIDsMask,
+		rate:             rateOne,
+		mode:             modeOffset,
+	}
+}
+
+// NewFreezeConfig creates a config which pins the clocks in clockIDsMask to instant.
+func NewFreezeConfig(instant time.Time, clockIDsMask uint64) *Config {
+	return &Config{
+		deltaSeconds:     instant.Unix(),
+		deltaNanoSeconds: int64(instant.Nanosecond()),
+		clockIDsMask:     clockIDsMask,
+		rate:             rateOne,
+		mode:             modeFreeze,
+	}
+}
+
+// SetRate makes the fake time run rate times as fast as the real time, starting from anchor.
+// The fake time at anchor is anchor plus the delta of config.
+func (c *Config) SetRate(rate float64, anchor time.Time) error {
+	if rate <= 0 || math.IsNaN(rate) || rate >= math.MaxInt32 {
+		return fmt.Errorf("invalid rate %v", rate)
+	}
+	c.rate = uint64(math.Round(rate * rateOne))
+	if c.rate == 0 {
+		return fmt.Errorf("rate %v is too small", rate)
 	}
+	c.rateAnchor = anchor.UnixNano()
+	return nil
 }
 
 func (c *Config) DeepCopy() *Config {
@@ -46,18 +97,74 @@ func (c *Config) DeepCopy() *Config {
 		deltaSeconds:     c.deltaSeconds,
 		deltaNanoSeconds: c.deltaNanoSeconds,
 		clockIDsMask:     c.clockIDsMask,
+		rate:             c.rate,
+		rateAnchor:       c.rateAnchor,
+		mode:             c.mode,
 	}
 }
 
 // Merge implement how to merge time skew tasks.
 func (c *Config) Merge(a *Config) {
 	// TODO: Add more reasonable merge method
+	if a.mode == modeFreeze {
+		// a frozen instant can't be added to a delta, the latest one wins
+		c.deltaSeconds = a.deltaSeconds
+		c.deltaNanoSeconds = a.deltaNanoSeconds
+		c.clockIDsMask |= a.clockIDsMask
+		c.mode = a.mode
+		return
+	}
 	c.deltaSeconds += a.deltaSeconds
 	c.deltaNanoSeconds += a.deltaNanoSeconds
 	c.clockIDsMask |= a.clockIDsMask
+	if a.rate != rateOne {
+		c.rate = a.rate
+		c.rateAnchor = a.rateAnchor
+	}
 	return
 }
 
+// fakeNanoseconds returns the fake time of the real time realNs in the same way as
+// the fake images. realNow is the real time of CLOCK_REALTIME which the rate applies to.
+func (c *Config) fakeNanoseconds(realNs int64, realNow int64) int64 {
+	if c.mode == modeFreeze {
+		return c.deltaSeconds*int64(time.Second) + c.deltaNanoSeconds
+	}
+	fake := realNs + c.deltaSeconds*int64(time.Second) + c.deltaNanoSeconds
+	if c.rate != 0 && c.rate != rateOne {
+		// the same as the 128 bits arithmetic in the fake images
+		extra := big.NewInt(realNow - c.rateAnchor)
+		extra.Mul(extra, big.NewInt(int64(c.rate)-rateOne))
+		extra.Rsh(extra, 32)
+		fake += extra.Int64()
+	}
+	return fake
+}
+
+// variables returns all extern variables of the fake images, a fake image uses
+// some of them, see imageVariables
+func (c *Config) variables() map[string]uint64 {
+	return map[string]uint64{
+		externVarClockIdsMask: c.clockIDsMask,
+		externVarTvSecDelta:   uint64(c.deltaSeconds),
+		externVarTvNsecDelta:  uint64(c.deltaNanoSeconds),
+		externVarRateAnchor:   uint64(c.rateAnchor),
+		externVarRate:         c.rate,
+		externVarFakeMode:     c.mode,
+	}
+}
+
+// imageVariables returns the extern variables used by image, e.g. fake_time.c
+// doesn't use CLOCK_IDS_MASK
+func (c *Config) imageVariables(image *FakeImage) map[string]uint64 {
+	all := c.variables()
+	vars := make(map[string]uint64, len(image.offset))
+	for name := range image.offset {
+		vars[name] = all[name]
+	}
+	return vars
+}
+
 type ConfigCreatorParas struct {
 	Config Config
 }
@@ -65,128 +172,285 @@ type ConfigCreatorParas struct {
 // Skew implements ProcessGroup.
 // We locked Skew injecting and recovering to avoid conflict.
 type Skew struct {
-	SkewConfig   *Config
-	time         *FakeImage
-	clockGetTime *FakeImage
-	getTimeOfDay *FakeImage
+	SkewConfig *Config
+	// images are the fake images of time, clock_gettime, gettimeofday and the
+	// symbols added by SetImage, they are injected in order
+	images []*FakeImage
+
+	// backend is BackendVDSO unless the skew is got by GetSkewWithBackend
+	backend Backend
+	// stopMode is StopModeAll unless it is set by SetStopMode
+	stopMode StopMode
+	// logger is nil unless it is set by SetLogger, the logger of the package is
+	// used then
+	logger *slog.Logger
+	// tracers are the running tracers of BackendSyscall by pid
+	tracers map[uint64]*syscallTracer
 
 	locker sync.Mutex
 }
 
 func GetSkew(c *Config) (*Skew, error) {
-	var timeImage *FakeImage
-	var err error
+	var images []*FakeImage
 
-	if runtime.GOARCH == "arm64" {
-		// __NR_time is deprecated on arm64
-		timeImage = nil
-	} else {
-		log.Println("loading timeSkewFakeImage")
-		timeImage, err = LoadFakeImageFromEmbedFs(timeSkewFakeImage, _time)
+	// there is no time in vDSO of arm64, see vdsoSymbolAliases
+	if _, ok := vdsoSymbolAliases[_time]; ok {
+		logger().Debug("loading timeSkewFakeImage")
+		timeImage, err := LoadFakeImageFromEmbedFs(timeSkewFakeImage, _time)
 		if err != nil {
 			return nil, fmt.Errorf("load fake image err: %v", err)
 		}
+		images = append(images, timeImage)
 	}
 
-	log.Println("loading clockGettimeSkewFakeImage")
+	logger().Debug("loading clockGettimeSkewFakeImage")
 	clockGetTimeImage, err := LoadFakeImageFromEmbedFs(clockGettimeSkewFakeImage, clockGettime)
 	if err != nil {
 		return nil, fmt.Errorf("load fake image err: %v", err)
 	}
 
-	log.Println("loading timeOfDaySkewFakeImage")
+	logger().Debug("loading timeOfDaySkewFakeImage")
 	getTimeOfDayimage, err := LoadFakeImageFromEmbedFs(timeOfDaySkewFakeImage, getTimeOfDay)
 	if err != nil {
 		return nil, fmt.Errorf("load fake image err: %v", err)
 	}
 
 	return &Skew{
-		SkewConfig:   c,
-		time:         timeImage,
-		clockGetTime: clockGetTimeImage,
-		getTimeOfDay: getTimeOfDayimage,
-		locker:       sync.Mutex{},
+		SkewConfig: c,
+		images:     append(images, clockGetTimeImage, getTimeOfDayimage),
+		backend:    BackendVDSO,
+		tracers:    make(map[uint64]*syscallTracer),
+		locker:     sync.Mutex{},
 	}, nil
 }
 
-func (s *Skew) Fork() (*Skew, error) {
-	// TODO : to KEAO can I share FakeImage between threads?
-	skew, err := GetSkew(s.SkewConfig)
+// GetSkewWithBackend is the same as GetSkew, but modifies the time with backend.
+func GetSkewWithBackend(c *Config, backend Backend) (*Skew, error) {
+	skew, err := GetSkew(c)
 	if err != nil {
 		return nil, err
 	}
-
+	skew.backend = backend
 	return skew, nil
 }
 
+// SetImage replaces the fake image of the same symbol, or adds the image if the
+// symbol is not replaced yet. The image may only use the extern variables of
+// the built-in images, which are set from SkewConfig.
+func (s *Skew) SetImage(image *FakeImage) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	known := s.SkewConfig.variables()
+	for name := range image.offset {
+		if _, ok := known[name]; !ok {
+			return fmt.Errorf("unknown extern variable %s in fake image of %s", name, image.symbolName)
+		}
+	}
+	image.stopMode = s.stopMode
+	image.logger = s.logger
+	for i, old := range s.images {
+		if old.symbolName == image.symbolName {
+			s.images[i] = image
+			return nil
+		}
+	}
+	s.images = append(s.images, image)
+	return nil
+}
+
+// SetStopMode sets how many threads of a process are stopped while the images
+// are injected, see StopModeMinimal. Update and Recover always stop every thread,
+// as the variables are written one by one, and the images may be running in any
+// thread when they are removed.
+func (s *Skew) SetStopMode(mode StopMode) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.stopMode = mode
+	for _, image := range s.images {
+		image.stopMode = mode
+	}
+}
+
+// SetLogger sets the logger of the skew and its images, which replaces the
+// logger of the package set by the package level SetLogger, so every skew of a
+// program may log to its own sink. The logs go to the logger of the package
+// again if l is nil. The images are loaded by GetSkew before, so the logs of
+// loading them go to the logger of the package.
+func (s *Skew) SetLogger(l *slog.Logger) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.logger = l
+	for _, image := range s.images {
+		image.logger = l
+	}
+}
+
+// log returns the logger of the skew
+func (s *Skew) log() *slog.Logger {
+	return loggerOr(s.logger)
+}
+
+// Fork returns a skew with the same config and fake images for another process.
+// The fake images keep the origin code of the process they are injected to, so
+// the forked skew has its own copies.
+func (s *Skew) Fork() (*Skew, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	images := make([]*FakeImage, len(s.images))
+	for i, image := range s.images {
+		images[i] = image.clone()
+	}
+	return &Skew{
+		SkewConfig: s.SkewConfig,
+		images:     images,
+		backend:    s.backend,
+		stopMode:   s.stopMode,
+		logger:     s.logger,
+		tracers:    make(map[uint64]*syscallTracer),
+		locker:     sync.Mutex{},
+	}, nil
+}
+
 func (s *Skew) Inject(sysPID uint64) error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
-	var err error
 
-	// s.time can be nil on arm64 as __NR_time is deprecated there
-	if s.time != nil {
-		log.Println("injecting time")
-		err = s.time.AttachToProcess(int(sysPID), map[string]uint64{
-			externVarTvSecDelta:  uint64(s.SkewConfig.deltaSeconds),
-			externVarTvNsecDelta: uint64(s.SkewConfig.deltaNanoSeconds),
-		})
+	return s.inject(context.Background(), sysPID)
+}
+
+// inject is Inject, which gives up between the phases of injecting if ctx is
+// done, the locker must be held
+func (s *Skew) inject(ctx context.Context, sysPID uint64) error {
+	if s.backend == BackendSyscall {
+		return s.injectSyscall(ctx, sysPID)
+	}
+	return s.injectImages(ctx, sysPID, s.SkewConfig)
+}
+
+// injectImages replaces the vDSO functions with fake images using the variables of c
+func (s *Skew) injectImages(ctx context.Context, sysPID uint64, c *Config) error {
+	for _, image := range s.images {
+		s.log().Debug("injecting", "symbol", image.symbolName, "pid", sysPID)
+		err := image.attachToProcess(ctx, int(sysPID), c.imageVariables(image))
 		if err != nil {
-			return err
+			return &SymbolError{Symbol: image.symbolName, Err: err}
 		}
 	}
+	return nil
+}
 
-	log.Println("injecting clock_gettime")
-	err = s.clockGetTime.AttachToProcess(int(sysPID), map[string]uint64{
-		externVarClockIdsMask: s.SkewConfig.clockIDsMask,
-		externVarTvSecDelta:   uint64(s.SkewConfig.deltaSeconds),
-		externVarTvNsecDelta:  uint64(s.SkewConfig.deltaNanoSeconds),
-	})
+// injectSyscall injects fake images which don't modify the time, so the vDSO
+// functions issue syscalls, then traces the process to rewrite the syscalls.
+// The process keeps being traced after exec, but only the syscalls are modified
+// as the new vDSO is not replaced.
+func (s *Skew) injectSyscall(ctx context.Context, sysPID uint64) error {
+	if tracer, ok := s.tracers[sysPID]; ok {
+		tracer.setConfig(s.SkewConfig)
+		return nil
+	}
+
+	err := s.injectImages(ctx, sysPID, NewConfig(0, 0, 0))
 	if err != nil {
 		return err
 	}
 
-	log.Println("injecting gettimeofday")
-	err = s.getTimeOfDay.AttachToProcess(int(sysPID), map[string]uint64{
-		externVarTvSecDelta:  uint64(s.SkewConfig.deltaSeconds),
-		externVarTvNsecDelta: uint64(s.SkewConfig.deltaNanoSeconds),
-	})
+	s.log().Info("tracing time syscalls", "pid", sysPID)
+	tracer, err := startSyscallTracer(int(sysPID), s.SkewConfig, s.logger)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w trace time syscalls, pid: %d", err, sysPID)
 	}
+	s.tracers[sysPID] = tracer
 	return nil
 }
 
-// Recover clock_get_time & get_time_of_day one by one ,
-// if error comes from clock_get_time.Recover we will continue recover another fake image
-// and merge errors.
-func (s *Skew) Recover(sysPID uint64) error {
+// Update rewrites the variables of fake images injected before with c, without
+// patching the vDSO again. It returns error if the process has not been injected.
+func (s *Skew) Update(sysPID uint64, c *Config) error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
-	err1 := s.clockGetTime.Recover(int(sysPID), map[string]uint64{
-		externVarClockIdsMask: s.SkewConfig.clockIDsMask,
-		externVarTvSecDelta:   uint64(s.SkewConfig.deltaSeconds),
-		externVarTvNsecDelta:  uint64(s.SkewConfig.deltaNanoSeconds),
-	})
-	if err1 != nil {
-		err2 := s.getTimeOfDay.Recover(int(sysPID), map[string]uint64{
-			externVarTvSecDelta:  uint64(s.SkewConfig.deltaSeconds),
-			externVarTvNsecDelta: uint64(s.SkewConfig.deltaNanoSeconds),
-		})
-		if err2 != nil {
-			return fmt.Errorf("%v time skew all failed %v", err1, err2)
+	return s.update(context.Background(), sysPID, c)
+}
+
+// update is Update, which gives up before writing the variables of an image if
+// ctx is done, the locker must be held
+func (s *Skew) update(ctx context.Context, sysPID uint64, c *Config) error {
+	var err error
+
+	if s.backend == BackendSyscall {
+		tracer, ok := s.tracers[sysPID]
+		if !ok {
+			return fmt.Errorf("%w, time syscalls are not traced, pid: %d", ErrNotInjected, sysPID)
 		}
-		return err1
+		tracer.setConfig(c)
+		s.SkewConfig = c
+		return nil
 	}
 
-	err2 := s.getTimeOfDay.Recover(int(sysPID), map[string]uint64{
-		externVarTvSecDelta:  uint64(s.SkewConfig.deltaSeconds),
-		externVarTvNsecDelta: uint64(s.SkewConfig.deltaNanoSeconds),
-	})
-	if err2 != nil {
-		return err2
+	for _, image := range s.images {
+		s.log().Info("updating", "symbol", image.symbolName, "pid", sysPID)
+		err = image.updateVariables(ctx, int(sysPID), c.imageVariables(image))
+		if err != nil {
+			return &SymbolError{Symbol: image.symbolName, Err: err}
+		}
 	}
 
+	s.SkewConfig = c
 	return nil
 }
+
+// Injected returns true if clock_gettime of the process has been replaced,
+// the process is not stopped. With BackendSyscall it is true while the syscalls
+// of the process are traced, even if the process has executed a new program,
+// whose vDSO is not replaced but whose syscalls are still modified.
+func (s *Skew) Injected(sysPID uint64) (bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if tracer, ok := s.tracers[sysPID]; ok && tracer.running() {
+		return true, nil
+	}
+	for _, image := range s.images {
+		if image.symbolName == clockGettime {
+			return image.Injected(int(sysPID))
+		}
+	}
+	return false, fmt.Errorf("no fake image of %s", clockGettime)
+}
+
+// Recover every fake image one by one in the reverse order of Inject,
+// if error comes from one of them we will continue recover another fake image
+// and join the errors, each of which names the symbol.
+func (s *Skew) Recover(sysPID uint64) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.recover(context.Background(), sysPID)
+}
+
+// recover is Recover, which gives up the images not recovered yet if ctx is
+// done, the locker must be held
+func (s *Skew) recover(ctx context.Context, sysPID uint64) error {
+
+	// the tracer is stopped first, as the images are recovered by tracing the process
+	if tracer, ok := s.tracers[sysPID]; ok {
+		s.log().Info("stop tracing time syscalls", "pid", sysPID)
+		tracer.stop()
+		delete(s.tracers, sysPID)
+	}
+
+	var errs []error
+	for i := len(s.images) - 1; i >= 0; i-- {
+		image := s.images[i]
+		s.log().Info("recovering", "symbol", image.symbolName, "pid", sysPID)
+		err := image.recover(ctx, int(sysPID))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w recover %s", err, image.symbolName))
+		}
+	}
+	return errors.Join(errs...)
+}
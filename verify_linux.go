@@ -0,0 +1,180 @@
+package watchmaker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrClockMismatch is returned by Verify if the time observed by the process is
+// not the fake time of the config
+var ErrClockMismatch = errors.New("observed time doesn't match the fake time")
+
+// timespecSize is the size of struct timespec of 64 bits linux
+const timespecSize = 16
+
+// Verification is the time read by clock_gettime inside a process, and the fake
+// time expected by the config, both in nanoseconds
+type Verification struct {
+	ClockID  int
+	Observed int64
+	Expected int64
+}
+
+// Difference returns how far the observed time is from the expected time
+func (v Verification) Difference() time.Duration {
+	return time.Duration(v.Observed - v.Expected)
+}
+
+// Verify reads every clock in the clock mask of SkewConfig by calling the
+// clock_gettime of vDSO inside the process, which jumps to the fake image if
+// the process is injected, and compares it with the fake time. It returns
+// ErrClockMismatch if any clock differs by more than tolerance. Only the main
+// thread of the process is stopped while the clocks are read.
+func (s *Skew) Verify(sysPID uint64, tolerance time.Duration) ([]Verification, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.backend == BackendSyscall {
+		// the process is traced by the syscall tracer already
+		return nil, fmt.Errorf("verify is not supported by %s backend", BackendSyscall)
+	}
+
+	var clockIDs []int
+	for clockID := 0; clockID < 64; clockID++ {
+		if s.SkewConfig.clockIDsMask&(1<<clockID) != 0 {
+			clockIDs = append(clockIDs, clockID)
+		}
+	}
+	if len(clockIDs) == 0 {
+		return nil, nil
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	program, err := traceMainThread(int(sysPID), s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("%w ptrace on target process, pid: %d", err, sysPID)
+	}
+	defer func() {
+		errIn := program.Detach()
+		if errIn != nil {
+			s.log().Warn("fail to detach program", "pid", sysPID, "error", errIn)
+		}
+	}()
+
+	clock, err := newRemoteClock(program)
+	if err != nil {
+		return nil, fmt.Errorf("%w, pid: %d", err, sysPID)
+	}
+	defer func() {
+		errIn := clock.close()
+		if errIn != nil {
+			s.log().Warn("fail to unmap scratch buffer", "pid", sysPID, "error", errIn)
+		}
+	}()
+
+	var verifications []Verification
+	var errs []error
+	for _, clockID := range clockIDs {
+		var before, after, realBefore, realAfter unix.Timespec
+		_ = unix.ClockGettime(int32(clockID), &before)
+		_ = unix.ClockGettime(unix.CLOCK_REALTIME, &realBefore)
+		observed, err := clock.gettime(clockID)
+		if err != nil {
+			return verifications, fmt.Errorf("%w clock_gettime of clock %d, pid: %d", err, clockID, sysPID)
+		}
+		_ = unix.ClockGettime(int32(clockID), &after)
+		_ = unix.ClockGettime(unix.CLOCK_REALTIME, &realAfter)
+
+		// the process reads the clock between before and after
+		realNs := (before.Nano() + after.Nano()) / 2
+		realNow := (realBefore.Nano() + realAfter.Nano()) / 2
+		verification := Verification{
+			ClockID:  clockID,
+			Observed: observed,
+			Expected: s.SkewConfig.fakeNanoseconds(realNs, realNow),
+		}
+		verifications = append(verifications, verification)
+
+		difference := verification.Difference()
+		if difference < -tolerance || difference > tolerance {
+			errs = append(errs, fmt.Errorf("%w, clock %d differs by %v, pid: %d", ErrClockMismatch, clockID, difference, sysPID))
+		}
+	}
+	return verifications, errors.Join(errs...)
+}
+
+// remoteClock calls the clock_gettime of vDSO inside a traced process. The
+// scratch buffer mapped into the process holds the trapInstr the call returns
+// to and the timespec written by clock_gettime, which is read by process_vm_readv.
+type remoteClock struct {
+	program  *TracedProgram
+	function uint64
+	// buffer is the page of trapInstr followed by the page of the timespec
+	buffer   uint64
+	pageSize uint64
+}
+
+// newRemoteClock maps the scratch buffer into program, which is unmapped by close
+func newRemoteClock(program *TracedProgram) (*remoteClock, error) {
+	vdsoEntry, err := FindVDSOEntry(program)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := program.FindSymbolsInEntry(clockGettime, vdsoEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	buffer, err := program.Mmap(2*pageSize, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w mmap scratch buffer", err)
+	}
+	clock := &remoteClock{
+		program:  program,
+		function: locations[0].Address,
+		buffer:   buffer,
+		pageSize: pageSize,
+	}
+
+	err = program.WriteSlice(buffer, trapInstr)
+	if err == nil {
+		err = program.Mprotect(buffer, pageSize, unix.PROT_READ|unix.PROT_EXEC)
+	}
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("%w write trap instruction", err), clock.close())
+	}
+	return clock, nil
+}
+
+// gettime returns the time of clockID in nanoseconds read inside the process
+func (c *remoteClock) gettime(clockID int) (int64, error) {
+	timespecAddr := c.buffer + c.pageSize
+	result, err := c.program.Call(c.function, c.buffer, uint64(clockID), timespecAddr)
+	if err != nil {
+		return 0, err
+	}
+	if int32(result) != 0 {
+		return 0, fmt.Errorf("clock_gettime returned %d", int32(result))
+	}
+
+	data, err := c.program.ReadSlice(timespecAddr, timespecSize)
+	if err != nil {
+		return 0, fmt.Errorf("%w ReadSlice failed", err)
+	}
+	sec := int64(endian.Uint64((*data)[0:8]))
+	nsec := int64(endian.Uint64((*data)[8:16]))
+	return sec*int64(time.Second) + nsec, nil
+}
+
+// close unmaps the scratch buffer
+func (c *remoteClock) close() error {
+	return c.program.Munmap(c.buffer, 2*c.pageSize)
+}